@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/tracyhatemice/gomailify/internal/dedup"
+	"github.com/tracyhatemice/gomailify/internal/forwarder"
+	"github.com/tracyhatemice/gomailify/internal/metrics"
+)
+
+// maxFailures is the number of failed messages listed per account.
+const maxFailures = 50
+
+// accountView is an account as reported by the admin API.
+type accountView struct {
+	Name      string         `json:"name"`
+	Protocol  string         `json:"protocol"`
+	Host      string         `json:"host"`
+	ForwardTo string         `json:"forward_to"`
+	Delivery  string         `json:"delivery"`
+	Mode      string         `json:"mode"` // "idle" while connected in IMAP IDLE, "polling" otherwise
+	Paused    bool           `json:"paused"`
+	DryRun    bool           `json:"dry_run"`
+	Healthy   bool           `json:"healthy"`
+	Status    metrics.Status `json:"status"`
+}
+
+// admin serves the admin API, which lists accounts and controls their
+// forwarders at runtime.
+type admin struct {
+	sup     *supervisor
+	metrics *metrics.Metrics
+	ctx     context.Context // cancelled at shutdown
+}
+
+// adminHandler returns the admin API. Every request must carry token as a
+// bearer token.
+func adminHandler(ctx context.Context, sup *supervisor, m *metrics.Metrics, token string) http.Handler {
+	a := &admin{sup: sup, metrics: m, ctx: ctx}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/accounts", a.list)
+	mux.HandleFunc("GET /api/accounts/{name}", a.get)
+	mux.HandleFunc("POST /api/accounts/{name}/poll", a.poll)
+	mux.HandleFunc("POST /api/accounts/{name}/pause", a.pause)
+	mux.HandleFunc("POST /api/accounts/{name}/resume", a.resume)
+	mux.HandleFunc("POST /api/accounts/{name}/reforward", a.reforward)
+	mux.HandleFunc("GET /api/accounts/{name}/messages", a.messages)
+	mux.HandleFunc("GET /api/accounts/{name}/failures", a.failures)
+	mux.HandleFunc("POST /api/accounts/{name}/retry", a.retry)
+	mux.HandleFunc("GET /api/errors", a.recentErrors)
+	return requireToken(token, mux)
+}
+
+// requireToken rejects requests that do not carry token as a bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gomailify"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) list(w http.ResponseWriter, r *http.Request) {
+	views := []accountView{}
+	for _, inst := range a.sup.instances() {
+		views = append(views, a.view(inst))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *admin) get(w http.ResponseWriter, r *http.Request) {
+	inst, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.view(inst))
+}
+
+// poll triggers an immediate mailbox check, bypassing the poll interval and
+// any error backoff. The check runs in the background.
+func (a *admin) poll(w http.ResponseWriter, r *http.Request) {
+	inst, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+	if inst.fwd.Paused() {
+		writeError(w, http.StatusConflict, errors.New("account is paused"))
+		return
+	}
+	queued := inst.fwd.PollNow()
+	writeJSON(w, http.StatusAccepted, map[string]bool{"queued": queued})
+}
+
+func (a *admin) pause(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, true)
+}
+
+func (a *admin) resume(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, false)
+}
+
+func (a *admin) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	inst, ok := a.sup.setPaused(r.PathValue("name"), paused)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such account"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.view(inst))
+}
+
+// reforward fetches the message with the Message-ID given in the request
+// body and forwards it again, waiting for the delivery to finish.
+func (a *admin) reforward(w http.ResponseWriter, r *http.Request) {
+	inst, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		MessageID string `json:"message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID == "" {
+		writeError(w, http.StatusBadRequest, errors.New(`body must be {"message_id": "..."}`))
+		return
+	}
+
+	// Delivery continues if the client goes away, but not past shutdown.
+	email, err := inst.fwd.Reforward(a.ctx, req.MessageID)
+	switch {
+	case errors.Is(err, forwarder.ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, forwarder.ErrUnsupported), errors.Is(err, forwarder.ErrDryRun):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err)
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{
+			"id":         email.ID,
+			"message_id": email.MessageID,
+			"forward_to": inst.acct.ForwardTo,
+		})
+	}
+}
+
+// messages lists the account's most recent deliveries, newest first.
+func (a *admin) messages(w http.ResponseWriter, r *http.Request) {
+	inst, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+	deliveries := a.metrics.Account(inst.acct.Name).Deliveries()
+	if deliveries == nil {
+		deliveries = []metrics.Delivery{}
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// failures lists the account's failed and dead-lettered messages from its
+// dedup state, most recent first.
+func (a *admin) failures(w http.ResponseWriter, r *http.Request) {
+	inst, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+	recs, err := inst.fwd.Failures(maxFailures)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if recs == nil {
+		recs = []dedup.Record{}
+	}
+	writeJSON(w, http.StatusOK, recs)
+}
+
+// retry makes the failed message with the dedup ID given in the request body
+// eligible for delivery again and checks the mailbox right away.
+func (a *admin) retry(w http.ResponseWriter, r *http.Request) {
+	inst, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		writeError(w, http.StatusBadRequest, errors.New(`body must be {"id": "..."}`))
+		return
+	}
+	switch err := inst.fwd.Retry(req.ID); {
+	case errors.Is(err, forwarder.ErrNoFailure):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": req.ID})
+	}
+}
+
+// recentErrors lists the most recent errors of every account, newest first.
+func (a *admin) recentErrors(w http.ResponseWriter, r *http.Request) {
+	events := a.metrics.Errors()
+	if events == nil {
+		events = []metrics.ErrorEvent{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// lookup returns the account named in the request path, answering 404 if it
+// is not running.
+func (a *admin) lookup(w http.ResponseWriter, r *http.Request) (*instance, bool) {
+	inst, ok := a.sup.instance(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such account"))
+	}
+	return inst, ok
+}
+
+func (a *admin) view(inst *instance) accountView {
+	status := a.metrics.Account(inst.acct.Name).Status()
+	mode := "polling"
+	if status.IdleConnected {
+		mode = "idle"
+	}
+	return accountView{
+		Name:      inst.acct.Name,
+		Protocol:  inst.acct.Protocol,
+		Host:      inst.acct.Host,
+		ForwardTo: inst.acct.ForwardTo,
+		Delivery:  inst.acct.GetDelivery(),
+		Mode:      mode,
+		Paused:    inst.fwd.Paused(),
+		DryRun:    inst.acct.DryRun,
+		Healthy:   healthy(status),
+		Status:    status,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false) // Message-IDs are full of < and >
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/tracyhatemice/gomailify/internal/config"
+	"github.com/tracyhatemice/gomailify/internal/dedup"
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+)
+
+// runBaseline implements "gomailify baseline [flags] [account...]". It records
+// every message currently in each account's mailbox as seen, so the daemon
+// forwards only mail that arrives afterwards.
+func runBaseline(args []string) int {
+	fs := flag.NewFlagSet("baseline", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "path to configuration file")
+	dataDir := fs.String("data-dir", "data", "directory for persistent data (dedup state)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gomailify baseline [flags] [account...]")
+		fmt.Fprintln(fs.Output(), "\nMark all existing mail seen without forwarding it. Defaults to every account.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	logger, err := setupLogger(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	names := fs.Args()
+	for _, name := range names {
+		if !slices.ContainsFunc(cfg.Accounts, func(a config.Account) bool { return a.Name == name }) {
+			fmt.Fprintf(os.Stderr, "error: unknown account %q\n", name)
+			return 1
+		}
+	}
+
+	status := 0
+	for _, acct := range cfg.Accounts {
+		if len(names) > 0 && !slices.Contains(names, acct.Name) {
+			continue
+		}
+		recv, err := newReceiver(acct, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", acct.Name, err)
+			status = 1
+			continue
+		}
+		base := statePath(*dataDir, acct.Name)
+		tracker, err := dedup.Open(base, cfg.Dedup.GetBackend(), dedup.Options{
+			GroupCommit: cfg.Dedup.GroupCommit(),
+			Logger:      logger,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", acct.Name, err)
+			status = 1
+			continue
+		}
+		added, err := baseline(acct, recv, tracker, logger)
+		total := tracker.Count()
+		tracker.Close()
+		if err == nil {
+			// The IDs now match the configured key.
+			err = dedup.RecordKey(base, acct.GetDedupKey())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", acct.Name, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: %d new message(s) marked seen, %d tracked in total\n", acct.Name, added, total)
+	}
+	return status
+}
+
+// baseline lists every message in the account's mailbox and records its ID
+// in tracker. It returns the number of IDs that were not already tracked.
+func baseline(acct config.Account, recv receiver.Receiver, tracker *dedup.Tracker, logger *slog.Logger) (int, error) {
+	lister, ok := recv.(receiver.Lister)
+	if !ok {
+		return 0, fmt.Errorf("protocol %s cannot list message IDs", acct.Protocol)
+	}
+
+	logger.Info("baselining existing mail", "account", acct.Name)
+	ids, err := lister.ListIDs()
+	if err != nil {
+		return 0, fmt.Errorf("list message IDs: %w", err)
+	}
+	added, err := tracker.MarkSeenBatch(ids, "baseline")
+	if err != nil {
+		return added, fmt.Errorf("record message IDs: %w", err)
+	}
+	logger.Info("baseline complete", "account", acct.Name, "listed", len(ids), "new", added)
+	return added, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tracyhatemice/gomailify/internal/config"
+)
+
+// runConfig implements "gomailify config <subcommand>".
+func runConfig(args []string) int {
+	if len(args) > 0 && args[0] == "check" {
+		return configCheck(args[1:])
+	}
+	fmt.Fprintln(os.Stderr, `Usage: gomailify config <command> [flags]
+
+Commands:
+  check    validate the configuration file and report every problem`)
+	return 2
+}
+
+// configCheck loads the configuration exactly as the daemon would and lists
+// every problem found, one per line. It exits non-zero if there are any.
+func configCheck(args []string) int {
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "path to configuration file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gomailify config check [flags]")
+		fmt.Fprintln(fs.Output(), "\nValidate the configuration without starting the daemon.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		var problems config.Problems
+		if !errors.As(err, &problems) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+			return 1
+		}
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, p)
+		}
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Printf("%s: OK, %d account(s)\n", *configPath, len(cfg.Accounts))
+	return 0
+}
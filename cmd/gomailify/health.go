@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/tracyhatemice/gomailify/internal/config"
+	"github.com/tracyhatemice/gomailify/internal/metrics"
+)
+
+const (
+	// unhealthyAfter is the number of consecutive failed mailbox checks, or
+	// failed deliveries, after which an account is reported unhealthy.
+	unhealthyAfter = 3
+
+	healthcheckTimeout = 10 * time.Second
+)
+
+// healthReport is the body of the /healthz and /readyz responses.
+type healthReport struct {
+	Status   string          `json:"status"` // "ok" or "failing"
+	Accounts []accountHealth `json:"accounts"`
+}
+
+type accountHealth struct {
+	metrics.Status
+	Healthy bool `json:"healthy"` // fewer than unhealthyAfter consecutive failures
+	Ready   bool `json:"ready"`   // checked the mailbox successfully at least once
+}
+
+// healthHandler serves the status of every running account. With ready set
+// it answers /readyz, which fails until every account has completed a
+// mailbox check; otherwise /healthz, which fails while any account keeps
+// failing to check its mailbox or to deliver.
+func healthHandler(m *metrics.Metrics, ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses := m.Statuses()
+		report := healthReport{Status: "ok", Accounts: make([]accountHealth, 0, len(statuses))}
+		ok := !ready || len(statuses) > 0
+		for _, st := range statuses {
+			h := accountHealth{
+				Status:  st,
+				Healthy: healthy(st),
+				Ready:   !st.LastFetch.IsZero() || st.IdleConnected,
+			}
+			if ready {
+				ok = ok && h.Ready
+			} else {
+				ok = ok && h.Healthy
+			}
+			report.Accounts = append(report.Accounts, h)
+		}
+
+		code := http.StatusOK
+		if !ok {
+			report.Status = "failing"
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, report)
+	}
+}
+
+// healthy reports whether an account has failed fewer than unhealthyAfter
+// times in a row, both at checking its mailbox and at delivering.
+func healthy(st metrics.Status) bool {
+	return st.ConsecutiveFetchErrors < unhealthyAfter && st.ConsecutiveForwardErrors < unhealthyAfter
+}
+
+// runHealthcheck implements "gomailify healthcheck". It queries the health
+// endpoint of a running daemon and exits non-zero unless it reports healthy,
+// so it can serve as the Docker HEALTHCHECK of the scratch image, which has
+// no shell or curl.
+func runHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "path to configuration file, read for http.listen")
+	url := fs.String("url", "", "endpoint to query instead of /healthz on http.listen")
+	ready := fs.Bool("ready", false, "query /readyz instead of /healthz")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gomailify healthcheck [flags]")
+		fmt.Fprintln(fs.Output(), "\nExit 0 if the running daemon reports healthy, 1 otherwise.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	target := *url
+	if target == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+			return 1
+		}
+		if cfg.HTTP.Listen == "" {
+			// Without a listener there is nothing to ask; do not mark
+			// every container that never enabled it as unhealthy.
+			fmt.Println("http.listen is not set, skipping health check")
+			return 0
+		}
+		path := "/healthz"
+		if *ready {
+			path = "/readyz"
+		}
+		target = "http://" + localAddr(cfg.HTTP.Listen) + path
+	}
+
+	client := &http.Client{Timeout: healthcheckTimeout}
+	resp, err := client.Get(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	var report healthReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck: %s: %v\n", resp.Status, err)
+		return 1
+	}
+	for _, a := range report.Accounts {
+		if a.Healthy && (a.Ready || !*ready) {
+			continue
+		}
+		if a.LastError != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.Account, a.LastError)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: not ready\n", a.Account)
+		}
+	}
+	fmt.Printf("%s: %s, %d account(s)\n", target, report.Status, len(report.Accounts))
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// localAddr turns a listen address into one to connect to on this host,
+// replacing an empty or wildcard host with the loopback address.
+func localAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -4,32 +4,76 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sync"
 	"syscall"
+	"time"
 
+	"github.com/tracyhatemice/gomailify/internal/alert"
+	"github.com/tracyhatemice/gomailify/internal/audit"
 	"github.com/tracyhatemice/gomailify/internal/config"
+	"github.com/tracyhatemice/gomailify/internal/dashboard"
 	"github.com/tracyhatemice/gomailify/internal/dedup"
 	"github.com/tracyhatemice/gomailify/internal/forwarder"
+	"github.com/tracyhatemice/gomailify/internal/logging"
+	"github.com/tracyhatemice/gomailify/internal/metrics"
 	"github.com/tracyhatemice/gomailify/internal/receiver"
 	"github.com/tracyhatemice/gomailify/internal/sender"
+	"github.com/tracyhatemice/gomailify/internal/tracing"
 )
 
+// commands maps subcommand names to their entry points. Each receives the
+// arguments after the subcommand name and returns the process exit code.
+var commands = map[string]func(args []string) int{
+	"audit":       runAudit,
+	"baseline":    runBaseline,
+	"config":      runConfig,
+	"healthcheck": runHealthcheck,
+	"run":         runDaemon,
+	"state":       runState,
+	"test":        runTest,
+}
+
 func main() {
-	configPath := flag.String("config", "config.yaml", "path to configuration file")
-	dataDir := flag.String("data-dir", "data", "directory for persistent data (dedup state)")
-	flag.Parse()
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+	os.Exit(runDaemon(os.Args[1:]))
+}
+
+// runDaemon implements "gomailify [run] [flags]": it forwards mail until
+// interrupted or, with --once, checks every account once and exits non-zero
+// if any failed.
+func runDaemon(args []string) int {
+	fs := flag.NewFlagSet("gomailify", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "path to configuration file")
+	dataDir := fs.String("data-dir", "data", "directory for persistent data (dedup state)")
+	dryRun := fs.Bool("dry-run", false, "fetch and log what would be forwarded without sending or marking seen")
+	watch := fs.Bool("watch-config", false, "reload the configuration when the file changes, as on SIGHUP")
+	once := fs.Bool("once", false, "check every account once, forward what is found and exit; non-zero if any account failed")
+	fs.Parse(args)
+	if *once && *watch {
+		fmt.Fprintln(os.Stderr, "error: --once and --watch-config cannot be combined")
+		return 2
+	}
 
 	cfg, err := config.Load(*configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 
-	logger := setupLogger(cfg.LogLevel)
+	logger, err := setupLogger(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
 	logger.Info("gomailify starting", "accounts", len(cfg.Accounts))
 
 	smtp := sender.New(
@@ -38,38 +82,112 @@ func main() {
 		cfg.Sender.Username,
 		cfg.Sender.Password,
 		cfg.Sender.UseTLS,
+		cfg.Sender.From,
 		logger,
 	)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	var wg sync.WaitGroup
+	if cfg.Tracing.Exporter != "" {
+		shutdown, err := tracing.Setup(ctx, cfg.Tracing.Exporter, cfg.Tracing.Endpoint)
+		if err != nil {
+			logger.Error("failed to set up tracing", "error", err)
+			return 1
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				logger.Error("failed to flush traces", "error", err)
+			}
+		}()
+		logger.Info("tracing enabled", "exporter", cfg.Tracing.Exporter)
+	}
 
-	for _, acct := range cfg.Accounts {
-		recv, err := newReceiver(acct, logger)
+	m := metrics.New()
+
+	var shared *dedup.Shared
+	if cfg.Dedup.GetScope() == config.ScopeDestination {
+		shared, err = dedup.OpenShared(*dataDir, cfg.Dedup.GetBackend(), dedup.Options{
+			GroupCommit: cfg.Dedup.GroupCommit(),
+			Logger:      logger,
+		})
 		if err != nil {
-			logger.Error("failed to create receiver", "account", acct.Name, "error", err)
-			continue
+			logger.Error("failed to open shared dedup state", "error", err)
+			return 1
 		}
+		defer shared.Close()
+		logger.Info("loaded shared dedup state", "count", shared.Count())
+		m.SetSharedSize(shared.Count)
+		if *once {
+			pruneShared(ctx, shared, cfg, true, logger)
+		} else {
+			go pruneShared(ctx, shared, cfg, false, logger)
+		}
+	}
 
-		dedupFile := filepath.Join(*dataDir, sanitize(acct.Name)+".seen")
-		tracker, err := dedup.NewTracker(dedupFile)
+	var auditLog *audit.Log
+	if cfg.Audit.Path != "" {
+		auditLog, err = audit.Open(cfg.Audit.Path, cfg.Audit.GetMaxSize(), cfg.Audit.MaxBackups, cfg.Audit.HashChain)
 		if err != nil {
-			logger.Error("failed to create dedup tracker", "account", acct.Name, "error", err)
-			continue
+			logger.Error("failed to open audit log", "error", err)
+			return 1
 		}
-		logger.Info("loaded dedup state", "account", acct.Name, "seen_count", tracker.Count())
+		defer auditLog.Close()
+		if n := auditLog.Torn(); n > 0 {
+			logger.Warn("moved an incomplete audit record aside", "file", audit.TornPath(cfg.Audit.Path), "bytes", n)
+		}
+		logger.Info("audit log enabled", "path", cfg.Audit.Path, "hash_chain", cfg.Audit.HashChain)
+	}
 
-		fwd := forwarder.New(acct, recv, smtp, tracker, logger)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			fwd.Run(ctx)
-		}()
+	sup := newSupervisor(*dataDir, *dryRun, smtp, shared, auditLog, m, logger)
+	if *once {
+		failed := sup.runOnce(ctx, cfg)
+		printDryRunReport(os.Stdout, sup.forwarders())
+		if failed > 0 {
+			logger.Error("run failed", "accounts", failed)
+			return 1
+		}
+		logger.Info("run complete")
+		return 0
+	}
+	if cfg.HTTP.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", m.Handler())
+		mux.Handle("GET /healthz", healthHandler(m, false))
+		mux.Handle("GET /readyz", healthHandler(m, true))
+		if cfg.HTTP.AdminToken != "" {
+			mux.Handle("/api/", adminHandler(ctx, sup, m, cfg.HTTP.AdminToken))
+			mux.Handle("/", dashboard.Handler())
+		}
+		if err := startHTTP(ctx, cfg.HTTP.Listen, mux, logger); err != nil {
+			logger.Error("failed to start http listener", "error", err)
+			return 1
+		}
+	}
+	sup.apply(ctx, cfg)
+	if cfg.Alerts.Enabled() {
+		go newAlertMonitor(cfg.Alerts, smtp, logger).Run(ctx, m.Statuses)
 	}
 
-	<-ctx.Done()
+	// SIGHUP, or a change to the file with --watch-config, reloads the
+	// configuration.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	changed := make(chan struct{}, 1)
+	if *watch {
+		go watchConfig(ctx, *configPath, changed, logger)
+	}
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-hup:
+			sup.reload(ctx, *configPath)
+		case <-changed:
+			sup.reload(ctx, *configPath)
+		}
+	}
 	logger.Info("shutting down, waiting for forwarders to finish...")
 
 	// Force exit on second signal.
@@ -81,8 +199,80 @@ func main() {
 		os.Exit(1)
 	}()
 
-	wg.Wait()
+	sup.wait()
+	printDryRunReport(os.Stdout, sup.forwarders())
 	logger.Info("gomailify stopped")
+	return 0
+}
+
+// newAlertMonitor returns a monitor that applies the rules of cfg and sends
+// alerts through smtp, a webhook, or both.
+func newAlertMonitor(cfg config.Alerts, smtp *sender.Sender, logger *slog.Logger) *alert.Monitor {
+	var notifiers []alert.Notifier
+	if cfg.Email != "" {
+		notifiers = append(notifiers, alert.NewEmail(smtp, cfg.Email))
+	}
+	if cfg.Webhook != "" {
+		notifiers = append(notifiers, alert.NewWebhook(cfg.Webhook))
+	}
+	return alert.NewMonitor(alert.Rules{
+		AuthFailures:    cfg.GetAuthFailures(),
+		FetchFailures:   cfg.GetFetchFailures(),
+		NoSync:          cfg.GetNoSync(),
+		ForwardFailures: cfg.GetForwardFailures(),
+		Repeat:          cfg.GetRepeat(),
+	}, notifiers, logger)
+}
+
+// printDryRunReport writes a summary of every dry-run forwarder's evaluated
+// emails. It prints nothing when no account ran in dry-run mode.
+func printDryRunReport(w io.Writer, fwds []*forwarder.Forwarder) {
+	header := false
+	for _, fwd := range fwds {
+		if !fwd.DryRun() {
+			continue
+		}
+		if !header {
+			fmt.Fprintln(w, "Dry-run summary (nothing was sent or marked seen):")
+			header = true
+		}
+		entries := fwd.DryRunReport()
+		fmt.Fprintf(w, "\n%s: %d message(s) → %s\n", fwd.Name(), len(entries), fwd.ForwardTo())
+		for _, e := range entries {
+			fmt.Fprintf(w, "  %s\n", e)
+		}
+	}
+}
+
+// pruneShared periodically forgets cross-account claims older than the
+// longest retention of any account, so no account can fetch a message whose
+// claim is already gone. With once set it prunes a single time and returns.
+func pruneShared(ctx context.Context, shared *dedup.Shared, cfg *config.Config, once bool, logger *slog.Logger) {
+	var retention time.Duration
+	for i := range cfg.Accounts {
+		r := cfg.Dedup.Retention(&cfg.Accounts[i])
+		if r == 0 {
+			return // some account keeps its IDs forever
+		}
+		retention = max(retention, r)
+	}
+
+	for {
+		if removed, err := shared.Prune(retention); err != nil {
+			logger.Error("shared dedup prune failed", "error", err)
+		} else if removed > 0 {
+			logger.Info("pruned shared dedup state", "removed", removed, "remaining", shared.Count())
+		}
+		if once {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(24 * time.Hour):
+		}
+	}
 }
 
 func newReceiver(acct config.Account, logger *slog.Logger) (receiver.Receiver, error) {
@@ -91,46 +281,78 @@ func newReceiver(acct config.Account, logger *slog.Logger) (receiver.Receiver, e
 		return receiver.NewPOP3(
 			acct.Name, acct.Host, acct.Port,
 			acct.Username, acct.Password,
-			acct.UseTLS, logger,
+			acct.UseTLS, acct.GetDedupKey(), logger,
 		), nil
 	case "imap":
 		return receiver.NewIMAP(
 			acct.Name, acct.Host, acct.Port,
 			acct.Username, acct.Password,
 			acct.UseTLS, acct.GetIMAPFolder(), acct.CheckInterval(),
-			acct.GetUseIdle(), logger,
+			acct.GetUseIdle(), acct.GetDedupKey(), logger,
 		), nil
 	default:
 		return nil, fmt.Errorf("unsupported protocol: %s", acct.Protocol)
 	}
 }
 
-func setupLogger(level string) *slog.Logger {
-	var lvl slog.Level
+// logLevels are the levels of the logger returned by setupLogger. They can
+// be changed at runtime, e.g. on configuration reload, with setLogLevels.
+var logLevels = new(logging.Levels)
+
+// setupLogger returns the logger configured by cfg, writing to stderr or to
+// the log file.
+func setupLogger(cfg *config.Config) (*slog.Logger, error) {
+	setLogLevels(cfg)
+
+	var w io.Writer = os.Stderr
+	if cfg.LogFile.Path != "" {
+		f, err := logging.OpenFile(cfg.LogFile.Path, cfg.LogFile.GetMaxSize(), cfg.LogFile.GetMaxBackups())
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	var h slog.Handler
+	if cfg.LogFormat == "json" {
+		h = slog.NewJSONHandler(w, logging.HandlerOptions())
+	} else {
+		h = slog.NewTextHandler(w, logging.HandlerOptions())
+	}
+	return slog.New(logging.NewHandler(h, logLevels)), nil
+}
+
+// cliLogger returns the logger of the offline subcommands, which report only
+// warnings and errors on stderr.
+func cliLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+}
+
+// setLogLevels applies the global log_level and every account's override.
+func setLogLevels(cfg *config.Config) {
+	accounts := make(map[string]slog.Level)
+	for _, acct := range cfg.Accounts {
+		if acct.LogLevel != "" {
+			accounts[acct.Name] = parseLevel(acct.LogLevel)
+		}
+	}
+	logLevels.Set(parseLevel(cfg.LogLevel), accounts)
+}
+
+func parseLevel(level string) slog.Level {
 	switch level {
 	case "debug":
-		lvl = slog.LevelDebug
+		return slog.LevelDebug
 	case "warn":
-		lvl = slog.LevelWarn
+		return slog.LevelWarn
 	case "error":
-		lvl = slog.LevelError
+		return slog.LevelError
 	default:
-		lvl = slog.LevelInfo
+		return slog.LevelInfo
 	}
-	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lvl}))
 }
 
-func sanitize(name string) string {
-	if name == "" {
-		return "default"
-	}
-	out := make([]byte, 0, len(name))
-	for _, b := range []byte(name) {
-		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '-' || b == '_' {
-			out = append(out, b)
-		} else {
-			out = append(out, '_')
-		}
-	}
-	return string(out)
+// statePath returns the common prefix of an account's files in dataDir.
+// Each kind of state appends its own extension.
+func statePath(dataDir, account string) string {
+	return filepath.Join(dataDir, config.StateName(account))
 }
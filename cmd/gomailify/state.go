@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tracyhatemice/gomailify/internal/config"
+	"github.com/tracyhatemice/gomailify/internal/dedup"
+)
+
+// stateCommands maps "gomailify state" subcommands to their entry points.
+var stateCommands = map[string]func(args []string) int{
+	"list":    stateList,
+	"export":  stateExport,
+	"import":  stateImport,
+	"merge":   stateMerge,
+	"rename":  stateRename,
+	"migrate": stateMigrate,
+}
+
+// runState implements "gomailify state <subcommand>", which inspects and
+// maintains the per-account dedup state under the data directory. Stop the
+// daemon first: the file backend has no lock to stop two writers.
+func runState(args []string) int {
+	if len(args) > 0 {
+		if cmd, ok := stateCommands[args[0]]; ok {
+			return cmd(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, `Usage: gomailify state <command> [flags] [args]
+
+Commands:
+  list                          show every stored state and its record counts
+  export <account>              write an account's records as JSON Lines
+  import <account> [file]       merge JSON Lines records into an account
+  merge <account> <source>...   merge other accounts' records into an account
+  rename <old> <new>            move an account's state to a new account name
+  migrate --to <backend> [account...]
+                                convert state between the bolt and file backends
+
+Run "gomailify state <command> -h" for the flags of each command.`)
+	return 2
+}
+
+// newStateFlags returns a flag set with the --data-dir flag shared by every
+// state subcommand.
+func newStateFlags(name, usage, desc string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("state "+name, flag.ExitOnError)
+	dataDir := fs.String("data-dir", "data", "directory for persistent data (dedup state)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gomailify state %s\n\n%s\n", usage, desc)
+		fs.PrintDefaults()
+	}
+	return fs, dataDir
+}
+
+// openState opens the existing state of account in dataDir. If there is none
+// and backend is non-empty, an empty store is created with backend instead.
+func openState(dataDir, account, backend string, logger *slog.Logger) (*dedup.Tracker, error) {
+	base := statePath(dataDir, account)
+	if found, ok := dedup.Detect(base); ok {
+		backend = found
+	} else if backend == "" {
+		return nil, fmt.Errorf("no state for account %q in %s", account, dataDir)
+	}
+	return dedup.Open(base, backend, dedup.Options{Logger: logger})
+}
+
+// readState opens the existing state of account in dataDir for reading only,
+// so that inspecting it never migrates, repairs or compacts it.
+func readState(dataDir, account string, logger *slog.Logger) (*dedup.Tracker, error) {
+	base := statePath(dataDir, account)
+	backend, ok := dedup.Detect(base)
+	if !ok {
+		return nil, fmt.Errorf("no state for account %q in %s", account, dataDir)
+	}
+	return dedup.OpenReadOnly(base, backend, dedup.Options{Logger: logger})
+}
+
+// stateStores returns the names of all stores in dataDir, as the file names
+// without their backend suffix.
+func stateStores(dataDir string) ([]string, error) {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		for _, backend := range []string{dedup.BackendBolt, dedup.BackendFile} {
+			if name, ok := strings.CutSuffix(e.Name(), dedup.Path("", backend)); ok && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func stateList(args []string) int {
+	fs, dataDir := newStateFlags("list", "list [flags]",
+		"Show every stored state with its record count per delivery state.")
+	configPath := fs.String("config", "config.yaml", "configuration used to flag state without a matching account; skipped if missing")
+	fs.Parse(args)
+
+	var accounts []string
+	cfg, err := config.Load(*configPath)
+	switch {
+	case err == nil:
+		for _, a := range cfg.Accounts {
+			accounts = append(accounts, config.StateName(a.Name))
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	names, err := stateStores(*dataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	logger := cliLogger()
+	status := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STORE\tBACKEND\tRECORDS\tSTATES\tNOTE")
+	for _, name := range names {
+		base := filepath.Join(*dataDir, name)
+		backend, _ := dedup.Detect(base)
+		tracker, err := dedup.OpenReadOnly(base, backend, dedup.Options{Logger: logger})
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t%v\n", name, backend, err)
+			status = 1
+			continue
+		}
+		counts := make(map[dedup.State]int)
+		err = tracker.ForEach(func(rec dedup.Record) error {
+			counts[rec.State]++
+			return nil
+		})
+		total := tracker.Count()
+		tracker.Close()
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t%v\n", name, backend, err)
+			status = 1
+			continue
+		}
+
+		note := ""
+		switch {
+		case strings.HasPrefix(name, "."):
+			note = "cross-account claims"
+		case cfg != nil && !slices.Contains(accounts, name):
+			note = "no matching account in config"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", name, backend, total, formatCounts(counts), note)
+	}
+	for _, name := range accounts {
+		if !slices.Contains(names, name) {
+			fmt.Fprintf(w, "%s\t-\t0\t-\tno state yet\n", name)
+		}
+	}
+	w.Flush()
+	return status
+}
+
+// formatCounts renders per-state record counts in the order of the state
+// machine, e.g. "forwarded=10 failed=1".
+func formatCounts(counts map[dedup.State]int) string {
+	var parts []string
+	for _, s := range []dedup.State{
+		dedup.StateDiscovered, dedup.StateForwarding, dedup.StateForwarded,
+		dedup.StateFailed, dedup.StateDeadLettered, dedup.StateFiltered,
+	} {
+		if n := counts[s]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", s, n))
+		}
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, " ")
+}
+
+func stateExport(args []string) int {
+	fs, dataDir := newStateFlags("export", "export [flags] <account>",
+		"Write every record of an account as one JSON object per line.")
+	output := fs.String("o", "", "output file (default stdout)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	tracker, err := readState(*dataDir, fs.Arg(0), cliLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	defer tracker.Close()
+
+	var recs []dedup.Record
+	if err := tracker.ForEach(func(rec dedup.Record) error {
+		recs = append(recs, rec)
+		return nil
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		if !recs[i].FirstSeen.Equal(recs[j].FirstSeen) {
+			return recs[i].FirstSeen.Before(recs[j].FirstSeen)
+		}
+		return recs[i].ID < recs[j].ID
+	})
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	bw := bufio.NewWriter(out)
+	enc := json.NewEncoder(bw)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "exported %d record(s) to %s\n", len(recs), *output)
+	}
+	return 0
+}
+
+func stateImport(args []string) int {
+	fs, dataDir := newStateFlags("import", "import [flags] <account> [file]",
+		"Merge JSON Lines records (as written by export) into an account, reading\n"+
+			"stdin when no file is given. A record for an ID that is already tracked\n"+
+			"is combined with it: a final state wins, otherwise the newer update.")
+	backend := fs.String("backend", "bolt", "backend to create the account's state with if it has none")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() == 2 {
+		f, err := os.Open(fs.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	recs, err := readRecords(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	tracker, err := openState(*dataDir, fs.Arg(0), *backend, cliLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	defer tracker.Close()
+	added, err := tracker.Import(recs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s: imported %d record(s), %d new, %d tracked in total\n", fs.Arg(0), len(recs), added, tracker.Count())
+	return 0
+}
+
+// readRecords decodes JSON Lines records, reporting the line of the first
+// invalid one.
+func readRecords(r io.Reader) ([]dedup.Record, error) {
+	var recs []dedup.Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var rec dedup.Record
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if rec.ID == "" {
+			return nil, fmt.Errorf("line %d: record has no id", line)
+		}
+		recs = append(recs, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read records: %w", err)
+	}
+	return recs, nil
+}
+
+func stateMerge(args []string) int {
+	fs, dataDir := newStateFlags("merge", "merge [flags] <account> <source>...",
+		"Merge the records of the source accounts into account, combining records\n"+
+			"for the same ID as import does. The sources are left untouched.")
+	backend := fs.String("backend", "bolt", "backend to create the account's state with if it has none")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 2
+	}
+
+	dst, sources := fs.Arg(0), fs.Args()[1:]
+	logger := cliLogger()
+	var recs []dedup.Record
+	for _, src := range sources {
+		if statePath(*dataDir, src) == statePath(*dataDir, dst) {
+			fmt.Fprintf(os.Stderr, "error: cannot merge %q into itself\n", src)
+			return 1
+		}
+		tracker, err := readState(*dataDir, src, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		err = tracker.ForEach(func(rec dedup.Record) error {
+			recs = append(recs, rec)
+			return nil
+		})
+		tracker.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", src, err)
+			return 1
+		}
+	}
+
+	tracker, err := openState(*dataDir, dst, *backend, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	defer tracker.Close()
+	added, err := tracker.Import(recs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s: merged %d record(s) from %s, %d new, %d tracked in total\n",
+		dst, len(recs), strings.Join(sources, ", "), added, tracker.Count())
+	return 0
+}
+
+func stateRename(args []string) int {
+	fs, dataDir := newStateFlags("rename", "rename [flags] <old> <new>",
+		"Move an account's dedup state and spooled mail to a new account name.\n"+
+			"Rename the account in the configuration to match before restarting.")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	oldName, newName := fs.Arg(0), fs.Arg(1)
+	oldBase, newBase := statePath(*dataDir, oldName), statePath(*dataDir, newName)
+	if oldBase == newBase {
+		fmt.Fprintf(os.Stderr, "error: %q and %q map to the same state file\n", oldName, newName)
+		return 1
+	}
+	if dedup.Exists(newBase) {
+		fmt.Fprintf(os.Stderr, "error: account %q already has state; use merge instead\n", newName)
+		return 1
+	}
+
+	// Opening fails if the daemon holds the bolt store.
+	logger := cliLogger()
+	tracker, err := openState(*dataDir, oldName, "", logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	tracker.Close()
+
+	var moves [][2]string
+	for _, suffix := range stateSuffixes() {
+		src, dst := oldBase+suffix, newBase+suffix
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if _, err := os.Stat(dst); err == nil {
+			fmt.Fprintf(os.Stderr, "error: %s already exists\n", dst)
+			return 1
+		}
+		moves = append(moves, [2]string{src, dst})
+	}
+	for _, m := range moves {
+		if err := os.Rename(m[0], m[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+	}
+
+	if backend, ok := dedup.DetectShared(*dataDir); ok {
+		shared, err := dedup.OpenShared(*dataDir, backend, dedup.Options{Logger: logger})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		n, err := shared.RenameOwner(oldName, newName)
+		shared.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cross-account claims: %v\n", err)
+			return 1
+		}
+		if n > 0 {
+			fmt.Printf("transferred %d cross-account claim(s)\n", n)
+		}
+	}
+
+	fmt.Printf("renamed state of %q to %q; update the account name in the configuration\n", oldName, newName)
+	return 0
+}
+
+// stateSuffixes returns the suffixes, appended to an account's state path, of
+// every file and directory that belongs to the account.
+func stateSuffixes() []string {
+	return []string{
+		dedup.Path("", dedup.BackendBolt),
+		dedup.Path("", dedup.BackendFile),
+		dedup.Path("", dedup.BackendFile) + ".migrated",
+		dedup.KeyPath(""),
+		".digest",
+		".held",
+	}
+}
+
+func stateMigrate(args []string) int {
+	fs, dataDir := newStateFlags("migrate", "migrate [flags] --to <backend> [account...]",
+		"Convert dedup state to another backend, by default for every store in the\n"+
+			"data directory. The old file is kept as <file>.migrated. Set dedup.backend\n"+
+			"in the configuration to match.")
+	to := fs.String("to", "", "target backend: bolt or file")
+	fs.Parse(args)
+	if *to != dedup.BackendBolt && *to != dedup.BackendFile {
+		fs.Usage()
+		return 2
+	}
+
+	var bases []string
+	if fs.NArg() > 0 {
+		for _, name := range fs.Args() {
+			bases = append(bases, statePath(*dataDir, name))
+		}
+	} else {
+		names, err := stateStores(*dataDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		for _, name := range names {
+			base := filepath.Join(*dataDir, name)
+			if backend, _ := dedup.Detect(base); backend != *to {
+				bases = append(bases, base)
+			}
+		}
+	}
+
+	logger := cliLogger()
+	status := 0
+	for _, base := range bases {
+		name := filepath.Base(base)
+		n, err := dedup.Migrate(base, *to, dedup.Options{Logger: logger})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: migrated %d record(s) to %s\n", name, n, *to)
+	}
+	return status
+}
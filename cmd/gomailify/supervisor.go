@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tracyhatemice/gomailify/internal/audit"
+	"github.com/tracyhatemice/gomailify/internal/config"
+	"github.com/tracyhatemice/gomailify/internal/dedup"
+	"github.com/tracyhatemice/gomailify/internal/forwarder"
+	"github.com/tracyhatemice/gomailify/internal/metrics"
+	"github.com/tracyhatemice/gomailify/internal/sender"
+	"github.com/tracyhatemice/gomailify/internal/spool"
+)
+
+// configPollInterval is how often --watch-config checks the file for changes.
+const configPollInterval = 5 * time.Second
+
+// supervisor runs one forwarder per configured account and applies new
+// configurations to the running set: accounts that were added are started,
+// removed ones stopped, and changed ones restarted, while unchanged accounts
+// keep their connections.
+type supervisor struct {
+	dataDir string
+	dryRun  bool
+	sender  *sender.Sender
+	shared  *dedup.Shared
+	audit   *audit.Log
+	metrics *metrics.Metrics
+	logger  *slog.Logger
+
+	applyMu sync.Mutex // serializes apply, which alone changes running
+
+	mu      sync.Mutex
+	cfg     *config.Config
+	running map[string]*instance
+	paused  map[string]bool                 // accounts paused through the admin API, kept across restarts
+	started map[string]*forwarder.Forwarder // latest forwarder of each account, for the dry-run report
+}
+
+// instance is one running forwarder.
+type instance struct {
+	acct   config.Account
+	fwd    *forwarder.Forwarder
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSupervisor(dataDir string, dryRun bool, smtp *sender.Sender, shared *dedup.Shared, auditLog *audit.Log, m *metrics.Metrics, logger *slog.Logger) *supervisor {
+	return &supervisor{
+		dataDir: dataDir,
+		dryRun:  dryRun,
+		sender:  smtp,
+		shared:  shared,
+		audit:   auditLog,
+		metrics: m,
+		logger:  logger,
+		running: make(map[string]*instance),
+		paused:  make(map[string]bool),
+		started: make(map[string]*forwarder.Forwarder),
+	}
+}
+
+// apply brings the running forwarders in line with cfg. The dedup, http,
+// tracing, alerts, audit and log output settings are fixed for the life of the
+// process; changes to them are reported and ignored. A changed account whose
+// new settings fail to start is restarted with its previous ones. Forwarders
+// are stopped and started without holding s.mu, so the admin API stays
+// responsive while they finish a delivery or open their state.
+func (s *supervisor) apply(ctx context.Context, cfg *config.Config) {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	s.mu.Lock()
+
+	if s.cfg != nil {
+		if cfg.Dedup != s.cfg.Dedup {
+			s.logger.Warn("dedup settings changed; restart to apply them")
+			cfg.Dedup = s.cfg.Dedup
+		}
+		if cfg.HTTP != s.cfg.HTTP {
+			s.logger.Warn("http settings changed; restart to apply them")
+			cfg.HTTP = s.cfg.HTTP
+		}
+		if !reflect.DeepEqual(cfg.Alerts, s.cfg.Alerts) {
+			s.logger.Warn("alerts settings changed; restart to apply them")
+			cfg.Alerts = s.cfg.Alerts
+		}
+		if cfg.Audit != s.cfg.Audit {
+			s.logger.Warn("audit settings changed; restart to apply them")
+			cfg.Audit = s.cfg.Audit
+		}
+		if cfg.Tracing != s.cfg.Tracing {
+			s.logger.Warn("tracing settings changed; restart to apply them")
+			cfg.Tracing = s.cfg.Tracing
+		}
+		if cfg.LogFormat != s.cfg.LogFormat || cfg.LogFile != s.cfg.LogFile {
+			s.logger.Warn("log_format and log_file changed; restart to apply them")
+			cfg.LogFormat, cfg.LogFile = s.cfg.LogFormat, s.cfg.LogFile
+		}
+		if !sameLogLevels(cfg, s.cfg) {
+			setLogLevels(cfg)
+			s.logger.Info("log levels changed", "level", cfg.LogLevel)
+		}
+		if cfg.Sender != s.cfg.Sender {
+			s.logger.Info("sender settings changed", "host", cfg.Sender.Host, "port", cfg.Sender.Port)
+		}
+	}
+	if s.cfg == nil || cfg.Sender != s.cfg.Sender {
+		applySender(s.sender, s.cfgSender(), cfg.Sender)
+	}
+	first := s.cfg == nil
+	s.cfg = cfg
+
+	wanted := make(map[string]config.Account, len(cfg.Accounts))
+	for _, acct := range cfg.Accounts {
+		if s.dryRun {
+			acct.DryRun = true
+		}
+		wanted[acct.Name] = acct
+	}
+	if first {
+		s.releaseRemovedClaims(cfg)
+	}
+
+	var stopping, removed []*instance
+	previous := make(map[string]config.Account)
+	for name, inst := range s.running {
+		acct, ok := wanted[name]
+		switch {
+		case !ok:
+			s.logger.Info("account removed, stopping", "account", name)
+			removed = append(removed, inst)
+		case !sameAccount(acct, inst.acct):
+			s.logger.Info("account changed, restarting", "account", name)
+			previous[name] = inst.acct
+		default:
+			continue
+		}
+		stopping = append(stopping, inst)
+		delete(s.running, name)
+	}
+	s.mu.Unlock()
+
+	stopAll(stopping)
+	for _, inst := range removed {
+		name := inst.acct.Name
+		s.releaseClaims(name)
+		s.metrics.Remove(name)
+		s.mu.Lock()
+		delete(s.paused, name)
+		s.mu.Unlock()
+	}
+	for _, acct := range cfg.Accounts {
+		s.mu.Lock()
+		_, ok := s.running[acct.Name]
+		s.mu.Unlock()
+		if ok {
+			continue
+		}
+		err := s.start(ctx, wanted[acct.Name])
+		if err == nil {
+			continue
+		}
+		prev, ok := previous[acct.Name]
+		if !ok {
+			s.logger.Error("failed to start account", "account", acct.Name, "error", err)
+			continue
+		}
+		s.logger.Error("new account settings rejected, keeping the previous ones", "account", acct.Name, "error", err)
+		if err := s.start(ctx, prev); err != nil {
+			s.logger.Error("failed to restart account", "account", acct.Name, "error", err)
+		}
+	}
+}
+
+// cfgSender returns the sender settings currently applied, or nil before the
+// first configuration.
+func (s *supervisor) cfgSender() *config.SMTP {
+	if s.cfg == nil {
+		return nil
+	}
+	return &s.cfg.Sender
+}
+
+// applySender updates smtp to the settings in next. The rate limiters are
+// rebuilt only when the limits changed, so a reload does not reset them.
+func applySender(smtp *sender.Sender, prev *config.SMTP, next config.SMTP) {
+	smtp.SetServer(next.Host, next.Port, next.Username, next.Password, next.UseTLS, next.From)
+	if prev != nil && prev.RateLimit == next.RateLimit && prev.DestinationRateLimit == next.DestinationRateLimit {
+		return
+	}
+	smtp.SetRateLimits(
+		sender.Limit{
+			MessagesPerMinute: next.RateLimit.MessagesPerMinute,
+			BytesPerHour:      next.RateLimit.BytesPerHour,
+		},
+		sender.Limit{
+			MessagesPerMinute: next.DestinationRateLimit.MessagesPerMinute,
+			BytesPerHour:      next.DestinationRateLimit.BytesPerHour,
+		},
+	)
+}
+
+// start opens the account's state and runs its forwarder until ctx is
+// cancelled or the account is stopped. s.mu must not be held.
+func (s *supervisor) start(ctx context.Context, acct config.Account) error {
+	fwd, closeFn, err := s.open(acct)
+	if err != nil {
+		return err
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	inst := &instance{acct: acct, fwd: fwd, cancel: cancel, done: make(chan struct{})}
+	s.mu.Lock()
+	if s.paused[acct.Name] {
+		fwd.Pause()
+	}
+	s.running[acct.Name] = inst
+	s.started[acct.Name] = fwd
+	s.mu.Unlock()
+	go func() {
+		defer close(inst.done)
+		defer closeFn()
+		fwd.Run(runCtx)
+	}()
+	return nil
+}
+
+// runOnce checks the mailbox of every account in cfg once, forwarding what
+// it finds, and returns when all are done. Accounts run concurrently. It
+// returns the number of accounts that failed to start, to check their
+// mailbox or to forward an email.
+func (s *supervisor) runOnce(ctx context.Context, cfg *config.Config) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	applySender(s.sender, nil, cfg.Sender)
+	s.releaseRemovedClaims(cfg)
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	fail := func(name string, msg string, err error) {
+		s.logger.Error(msg, "account", name, "error", err)
+		mu.Lock()
+		failed++
+		mu.Unlock()
+	}
+	for _, acct := range cfg.Accounts {
+		if s.dryRun {
+			acct.DryRun = true
+		}
+		fwd, closeFn, err := s.open(acct)
+		if err != nil {
+			fail(acct.Name, "failed to start account", err)
+			continue
+		}
+		s.started[acct.Name] = fwd
+		wg.Go(func() {
+			defer closeFn()
+			if err := fwd.RunOnce(ctx); err != nil {
+				fail(acct.Name, "run failed", err)
+			}
+		})
+	}
+	wg.Wait()
+	return failed
+}
+
+// open creates the account's receiver and opens its state, returning its
+// forwarder and a function that releases them. It reads s.cfg, so it must be
+// called from apply or runOnce.
+func (s *supervisor) open(acct config.Account) (*forwarder.Forwarder, func(), error) {
+	recv, err := newReceiver(acct, s.logger)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create receiver: %w", err)
+	}
+
+	base := statePath(s.dataDir, acct.Name)
+	firstRun := !dedup.Exists(base)
+	tracker, err := dedup.Open(base, s.cfg.Dedup.GetBackend(), dedup.Options{
+		GroupCommit: s.cfg.Dedup.GroupCommit(),
+		Logger:      s.logger,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("create dedup tracker: %w", err)
+	}
+	s.logger.Info("loaded dedup state",
+		"account", acct.Name,
+		"backend", s.cfg.Dedup.GetBackend(),
+		"seen_count", tracker.Count(),
+	)
+
+	if !acct.DryRun {
+		if n, err := tracker.Recover(); err != nil {
+			s.logger.Error("failed to recover delivery state", "account", acct.Name, "error", err)
+		} else if n > 0 {
+			s.logger.Warn("retrying deliveries interrupted by previous shutdown", "account", acct.Name, "count", n)
+		}
+	}
+
+	if err := checkDedupKey(base, acct, s.logger); err != nil {
+		tracker.Close()
+		return nil, nil, err
+	}
+
+	if firstRun && acct.BaselineOnFirstRun && !acct.DryRun {
+		if _, err := baseline(acct, recv, tracker, s.logger); err != nil {
+			// Forwarding now would replay the whole process_days window.
+			tracker.Close()
+			return nil, nil, fmt.Errorf("baseline failed, not starting account: %w", err)
+		}
+	}
+
+	opts := forwarder.Options{
+		Retention: s.cfg.Dedup.Retention(&acct),
+		Shared:    s.shared,
+		Audit:     s.audit,
+		Metrics:   s.metrics.Account(acct.Name),
+	}
+	if acct.GetDelivery() == config.DeliveryDigest {
+		opts.Digest, err = spool.Open(base + ".digest")
+		if err != nil {
+			tracker.Close()
+			return nil, nil, fmt.Errorf("open digest spool: %w", err)
+		}
+		s.logger.Info("loaded digest spool", "account", acct.Name, "pending", opts.Digest.Len())
+	}
+	if acct.Schedule != nil {
+		opts.Held, err = spool.Open(base + ".held")
+		if err != nil {
+			tracker.Close()
+			return nil, nil, fmt.Errorf("open held spool: %w", err)
+		}
+		s.logger.Info("loaded held spool", "account", acct.Name, "pending", opts.Held.Len())
+	}
+
+	fwd := forwarder.New(acct, recv, s.sender, tracker, s.logger, opts)
+	fwd.ReleaseClaims()
+	return fwd, func() {
+		recv.Close()
+		tracker.Close()
+	}, nil
+}
+
+// checkDedupKey compares the account's dedup_key with the one its state was
+// recorded with. A different key gives every message a new ID, so the whole
+// process_days window would be forwarded again; such an account is refused
+// until the mailbox has been baselined under the new key. State recorded
+// before keys were tracked is assumed to match.
+func checkDedupKey(base string, acct config.Account, logger *slog.Logger) error {
+	stored, err := dedup.StoredKey(base)
+	if err != nil {
+		return err
+	}
+	key := acct.GetDedupKey()
+	switch {
+	case stored == key:
+		return nil
+	case acct.DryRun:
+		if stored != "" {
+			logger.Warn("dedup_key differs from the one the state was recorded with; mail already forwarded will look new",
+				"account", acct.Name,
+				"dedup_key", key,
+				"recorded", stored,
+			)
+		}
+		return nil
+	case stored == "":
+		return dedup.RecordKey(base, key)
+	}
+	return fmt.Errorf("dedup_key is %s but the state was recorded with %s, so all mail in the process_days window would be forwarded again; "+
+		"restore dedup_key, or run \"gomailify baseline %s\" to accept the new key", key, stored, acct.Name)
+}
+
+// stopAll cancels the forwarders of insts and waits for each to finish its
+// current delivery and release its state.
+func stopAll(insts []*instance) {
+	for _, inst := range insts {
+		inst.cancel()
+	}
+	for _, inst := range insts {
+		<-inst.done
+	}
+}
+
+// releaseRemovedClaims gives up the cross-account claims of accounts removed
+// from the configuration while the process was not running. s.mu must be
+// held.
+func (s *supervisor) releaseRemovedClaims(cfg *config.Config) {
+	if s.shared == nil || s.dryRun {
+		return
+	}
+	owners, err := s.shared.Owners()
+	if err != nil {
+		s.logger.Error("read cross-account claims failed", "error", err)
+		return
+	}
+	for _, name := range owners {
+		if !slices.ContainsFunc(cfg.Accounts, func(a config.Account) bool { return a.Name == name }) {
+			s.releaseClaims(name)
+		}
+	}
+}
+
+// releaseClaims gives up every cross-account claim of a removed account, so
+// other accounts forward their copies of messages it never delivered.
+func (s *supervisor) releaseClaims(name string) {
+	if s.shared == nil || s.dryRun {
+		return
+	}
+	n, err := s.shared.ReleaseOwner(name, "", nil)
+	if err != nil {
+		s.logger.Error("release cross-account claims failed", "account", name, "error", err)
+	} else if n > 0 {
+		s.logger.Info("released cross-account claims of removed account", "account", name, "count", n)
+	}
+}
+
+// reload loads the configuration at path and applies it. An invalid
+// configuration is rejected and the current one keeps running.
+func (s *supervisor) reload(ctx context.Context, path string) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		s.logger.Error("config reload rejected, keeping current configuration", "error", err)
+		return
+	}
+	s.logger.Info("reloading configuration", "accounts", len(cfg.Accounts))
+	s.apply(ctx, cfg)
+}
+
+// wait blocks until every forwarder has stopped after ctx was cancelled.
+func (s *supervisor) wait() {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	for _, inst := range s.instances() {
+		<-inst.done
+	}
+}
+
+// sameAccount reports whether a and b differ only in settings that apply
+// without restarting the account's forwarder.
+func sameAccount(a, b config.Account) bool {
+	a.LogLevel, b.LogLevel = "", ""
+	return reflect.DeepEqual(a, b)
+}
+
+// sameLogLevels reports whether a and b set the same global and per-account
+// log levels.
+func sameLogLevels(a, b *config.Config) bool {
+	if a.LogLevel != b.LogLevel || len(a.Accounts) != len(b.Accounts) {
+		return false
+	}
+	for i := range a.Accounts {
+		if a.Accounts[i].Name != b.Accounts[i].Name || a.Accounts[i].LogLevel != b.Accounts[i].LogLevel {
+			return false
+		}
+	}
+	return true
+}
+
+// instances returns the running forwarders, ordered by account name.
+func (s *supervisor) instances() []*instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*instance, 0, len(s.running))
+	for _, inst := range s.running {
+		out = append(out, inst)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].acct.Name < out[j].acct.Name })
+	return out
+}
+
+// instance returns the running forwarder of the named account.
+func (s *supervisor) instance(name string) (*instance, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, ok := s.running[name]
+	return inst, ok
+}
+
+// setPaused pauses or resumes the named account. The setting survives a
+// restart of the account on reload, but not of the process.
+func (s *supervisor) setPaused(name string, paused bool) (*instance, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, ok := s.running[name]
+	if !ok {
+		return nil, false
+	}
+	if paused {
+		s.paused[name] = true
+		inst.fwd.Pause()
+	} else {
+		delete(s.paused, name)
+		inst.fwd.Resume()
+	}
+	return inst, true
+}
+
+// forwarders returns the latest forwarder started for each account, ordered
+// by account name.
+func (s *supervisor) forwarders() []*forwarder.Forwarder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*forwarder.Forwarder, 0, len(s.started))
+	for _, fwd := range s.started {
+		out = append(out, fwd)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out
+}
+
+// watchConfig signals changed whenever the file at path is modified. It polls
+// rather than relying on filesystem events, which are unreliable for files
+// mounted into containers.
+func watchConfig(ctx context.Context, path string, changed chan<- struct{}, logger *slog.Logger) {
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	lastMod, lastSize := stat()
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mod, size := stat()
+		if size < 0 || (mod.Equal(lastMod) && size == lastSize) {
+			continue
+		}
+		lastMod, lastSize = mod, size
+		logger.Info("configuration file changed", "file", path)
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
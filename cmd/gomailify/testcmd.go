@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tracyhatemice/gomailify/internal/config"
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+	"github.com/tracyhatemice/gomailify/internal/sender"
+)
+
+// certWarnDays is how close to expiry a certificate is flagged.
+const certWarnDays = 14
+
+// runTest implements "gomailify test [flags] [account...]". It checks the
+// connection, TLS, capabilities and login of each account and of the sender,
+// without forwarding or changing any mail.
+func runTest(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "path to configuration file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gomailify test [flags] [account...]")
+		fmt.Fprintln(fs.Output(), "\nTest the connection to each account (defaults to every account) and to")
+		fmt.Fprintln(fs.Output(), "the sender. Nothing is fetched or forwarded.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	logger := cliLogger()
+
+	names := fs.Args()
+	for _, name := range names {
+		if !slices.ContainsFunc(cfg.Accounts, func(a config.Account) bool { return a.Name == name }) {
+			fmt.Fprintf(os.Stderr, "error: unknown account %q\n", name)
+			return 1
+		}
+	}
+
+	status := 0
+	for _, acct := range cfg.Accounts {
+		if len(names) > 0 && !slices.Contains(names, acct.Name) {
+			continue
+		}
+		fmt.Printf("account %s (%s)\n", acct.Name, acct.Protocol)
+		recv, err := newReceiver(acct, logger)
+		if err != nil {
+			fmt.Printf("  FAILED: %v\n\n", err)
+			status = 1
+			continue
+		}
+		tester, ok := recv.(receiver.Tester)
+		if !ok {
+			fmt.Printf("  FAILED: %s receivers cannot be tested\n\n", acct.Protocol)
+			status = 1
+			continue
+		}
+		d := tester.Test(acct.GetProcessDays())
+		recv.Close()
+		printAccountDiagnosis(os.Stdout, acct, d)
+		if d.Err != nil {
+			status = 1
+		}
+	}
+
+	fmt.Println("sender")
+	smtp := sender.New(cfg.Sender.Host, cfg.Sender.Port, cfg.Sender.Username, cfg.Sender.Password, cfg.Sender.UseTLS, cfg.Sender.From, logger)
+	d := smtp.Test()
+	printSenderDiagnosis(os.Stdout, d)
+	if d.Err != nil {
+		status = 1
+	}
+	return status
+}
+
+// printAccountDiagnosis reports each step of an account's test that was
+// reached.
+func printAccountDiagnosis(w io.Writer, acct config.Account, d receiver.Diagnosis) {
+	line := func(label, format string, args ...any) {
+		fmt.Fprintf(w, "  %-13s %s\n", label+":", fmt.Sprintf(format, args...))
+	}
+	line("address", "%s", d.Addr)
+	if d.Connected {
+		printTLS(line, d.TLS)
+		switch acct.Protocol {
+		case "imap":
+			if d.LoggedIn {
+				line("capabilities", "%s", strings.Join(d.Capabilities, " "))
+				switch {
+				case !acct.GetUseIdle():
+					line("idle", "disabled by use_idle; the account polls")
+				case slices.Contains(d.Capabilities, "IDLE"):
+					line("idle", "supported; new mail is pushed")
+				default:
+					line("idle", "not supported; the account polls every %s", acct.CheckInterval())
+				}
+			}
+		case "pop3":
+			if len(d.Capabilities) == 0 {
+				line("capabilities", "none (CAPA not supported)")
+			} else {
+				line("capabilities", "%s", strings.Join(d.Capabilities, ", "))
+			}
+			if slices.ContainsFunc(d.Capabilities, func(c string) bool { return strings.EqualFold(c, "UIDL") }) {
+				line("uidl", "supported; known messages are not downloaded again")
+			} else {
+				line("uidl", "not advertised; every message may be downloaded on each poll")
+			}
+		}
+	}
+	if d.LoggedIn {
+		line("login", "OK")
+	}
+	if d.Err == nil {
+		where := "mailbox"
+		if d.Folder != "" {
+			where = fmt.Sprintf("folder %s", d.Folder)
+		}
+		line("messages", "%d in %s, %d in the last %d day(s)", d.Messages, where, d.InWindow, acct.GetProcessDays())
+	}
+	printResult(w, d.Err)
+}
+
+// printSenderDiagnosis reports each step of the sender's test that was
+// reached.
+func printSenderDiagnosis(w io.Writer, d sender.Diagnosis) {
+	line := func(label, format string, args ...any) {
+		fmt.Fprintf(w, "  %-13s %s\n", label+":", fmt.Sprintf(format, args...))
+	}
+	line("address", "%s", d.Addr)
+	if d.Connected {
+		printTLS(line, d.TLS)
+		if d.StartTLS {
+			line("starttls", "OK")
+		}
+		if len(d.Extensions) > 0 {
+			line("extensions", "%s", strings.Join(d.Extensions, ", "))
+		}
+	}
+	switch {
+	case d.Auth:
+		line("login", "OK")
+	case d.Err == nil:
+		line("login", "skipped, no credentials configured")
+	}
+	printResult(w, d.Err)
+}
+
+// printTLS reports the TLS version, cipher suite and server certificate of a
+// connection, or that it is not encrypted.
+func printTLS(line func(label, format string, args ...any), state *tls.ConnectionState) {
+	if state == nil {
+		line("tls", "none; the connection is not encrypted")
+		return
+	}
+	line("tls", "%s, %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	line("certificate", "%s", cert.Subject)
+	if len(cert.DNSNames) > 0 {
+		line("names", "%s", strings.Join(cert.DNSNames, ", "))
+	}
+	line("issuer", "%s", cert.Issuer)
+	days := int(time.Until(cert.NotAfter).Hours() / 24)
+	expiry := fmt.Sprintf("%s (%d day(s))", cert.NotAfter.UTC().Format(time.DateOnly), days)
+	if days < certWarnDays {
+		expiry += ", renew soon"
+	}
+	line("valid until", "%s", expiry)
+}
+
+// printResult ends the report of one test with its outcome.
+func printResult(w io.Writer, err error) {
+	if err != nil {
+		fmt.Fprintf(w, "  FAILED: %v\n\n", err)
+		return
+	}
+	fmt.Fprintln(w, "  OK")
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,219 @@
+// Package alert notifies an administrator when an account stops working and
+// again when it recovers.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/tracyhatemice/gomailify/internal/metrics"
+)
+
+// checkInterval is how often Run evaluates the rules.
+const checkInterval = time.Minute
+
+// Rule names, as reported in Alert.Rule.
+const (
+	RuleAuthFailure     = "auth_failure"
+	RuleFetchFailures   = "fetch_failures"
+	RuleNoSync          = "no_sync"
+	RuleForwardFailures = "forward_failures"
+)
+
+// rules lists the rules in the order their alerts are sent.
+var rules = []string{RuleAuthFailure, RuleFetchFailures, RuleNoSync, RuleForwardFailures}
+
+// Alert statuses.
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// Rules selects the conditions that raise an alert. A zero threshold
+// disables its rule.
+type Rules struct {
+	AuthFailures    bool          // the last mailbox check was refused a login
+	FetchFailures   int           // consecutive failed mailbox checks
+	NoSync          time.Duration // time since the last successful mailbox check
+	ForwardFailures int           // consecutive failed deliveries, not counting dead-lettered messages
+	Repeat          time.Duration // resend an unresolved alert after this long; 0 never
+}
+
+// Alert is one notification about an account.
+type Alert struct {
+	Account string    `json:"account"`
+	Rule    string    `json:"rule"`
+	Status  string    `json:"status"` // StatusFiring or StatusResolved
+	Summary string    `json:"summary"`
+	Error   string    `json:"error,omitempty"` // the account's last error
+	Since   time.Time `json:"since"`           // when the problem was detected
+	Time    time.Time `json:"time"`
+}
+
+// Text returns a one-line description of a.
+func (a Alert) Text() string {
+	if a.Status == StatusResolved {
+		return fmt.Sprintf("[gomailify] RESOLVED %s: %s", a.Account, a.Summary)
+	}
+	if a.Error != "" {
+		return fmt.Sprintf("[gomailify] %s: %s (%s)", a.Account, a.Summary, a.Error)
+	}
+	return fmt.Sprintf("[gomailify] %s: %s", a.Account, a.Summary)
+}
+
+// Notifier delivers alerts.
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// Monitor evaluates the rules against the status of every account. Each
+// problem is announced once when it starts, optionally repeated while it
+// lasts, and followed by a recovery notice when it ends.
+type Monitor struct {
+	rules     Rules
+	notifiers []Notifier
+	logger    *slog.Logger
+
+	firing    map[key]*problem
+	firstSeen map[string]time.Time // when each account first appeared
+}
+
+type key struct{ account, rule string }
+
+type problem struct {
+	since    time.Time
+	summary  string
+	notified time.Time // zero until a notifier accepted the alert
+}
+
+// NewMonitor creates a monitor that sends alerts to every notifier.
+func NewMonitor(rules Rules, notifiers []Notifier, logger *slog.Logger) *Monitor {
+	return &Monitor{
+		rules:     rules,
+		notifiers: notifiers,
+		logger:    logger,
+		firing:    make(map[key]*problem),
+		firstSeen: make(map[string]time.Time),
+	}
+}
+
+// Run checks the accounts returned by statuses every minute until ctx is
+// cancelled.
+func (m *Monitor) Run(ctx context.Context, statuses func() []metrics.Status) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.Check(ctx, now, statuses())
+		}
+	}
+}
+
+// Check evaluates the rules for statuses at time now and sends the alerts
+// that are due. Problems of accounts missing from statuses are forgotten.
+func (m *Monitor) Check(ctx context.Context, now time.Time, statuses []metrics.Status) {
+	present := make(map[string]bool, len(statuses))
+	for _, st := range statuses {
+		present[st.Account] = true
+		if _, ok := m.firstSeen[st.Account]; !ok {
+			m.firstSeen[st.Account] = now
+		}
+		active := m.evaluate(st, now)
+
+		for _, rule := range rules {
+			k := key{st.Account, rule}
+			p := m.firing[k]
+			summary, ok := active[rule]
+			if !ok {
+				if p != nil {
+					delete(m.firing, k)
+					if !p.notified.IsZero() {
+						m.notify(ctx, Alert{
+							Account: st.Account,
+							Rule:    rule,
+							Status:  StatusResolved,
+							Summary: p.summary,
+							Since:   p.since,
+							Time:    now,
+						})
+					}
+				}
+				continue
+			}
+			if p == nil {
+				p = &problem{since: now}
+				m.firing[k] = p
+			}
+			p.summary = summary
+			if p.notified.IsZero() || (m.rules.Repeat > 0 && now.Sub(p.notified) >= m.rules.Repeat) {
+				if m.notify(ctx, Alert{
+					Account: st.Account,
+					Rule:    rule,
+					Status:  StatusFiring,
+					Summary: summary,
+					Error:   st.LastError,
+					Since:   p.since,
+					Time:    now,
+				}) {
+					p.notified = now
+				}
+			}
+		}
+	}
+
+	for k := range m.firing {
+		if !present[k.account] {
+			delete(m.firing, k)
+		}
+	}
+	for account := range m.firstSeen {
+		if !present[account] {
+			delete(m.firstSeen, account)
+		}
+	}
+}
+
+// evaluate returns a summary of every problem st shows, by rule.
+func (m *Monitor) evaluate(st metrics.Status, now time.Time) map[string]string {
+	active := make(map[string]string)
+	if m.rules.AuthFailures && st.AuthFailed {
+		active[RuleAuthFailure] = "cannot log in, the server rejected the credentials"
+	}
+	if n := m.rules.FetchFailures; n > 0 && st.ConsecutiveFetchErrors >= n {
+		active[RuleFetchFailures] = fmt.Sprintf("%d consecutive mailbox checks failed", st.ConsecutiveFetchErrors)
+	}
+	// An IDLE session only checks the mailbox when mail arrives, so a
+	// connected one counts as in sync.
+	if m.rules.NoSync > 0 && !st.IdleConnected {
+		if st.LastFetch.IsZero() {
+			if now.Sub(m.firstSeen[st.Account]) >= m.rules.NoSync {
+				active[RuleNoSync] = fmt.Sprintf("no successful mailbox check since start, over %s ago", m.rules.NoSync)
+			}
+		} else if now.Sub(st.LastFetch) >= m.rules.NoSync {
+			active[RuleNoSync] = fmt.Sprintf("no successful mailbox check since %s", st.LastFetch.Format(time.RFC1123Z))
+		}
+	}
+	if n := m.rules.ForwardFailures; n > 0 && st.ConsecutiveForwardErrors >= n {
+		active[RuleForwardFailures] = fmt.Sprintf("%d consecutive deliveries failed", st.ConsecutiveForwardErrors)
+	}
+	return active
+}
+
+// notify sends a to every notifier and reports whether any accepted it.
+func (m *Monitor) notify(ctx context.Context, a Alert) bool {
+	m.logger.Warn("alert", "account", a.Account, "rule", a.Rule, "status", a.Status, "summary", a.Summary)
+	sent := false
+	for _, n := range m.notifiers {
+		if err := n.Notify(ctx, a); err != nil {
+			m.logger.Error("send alert failed", "account", a.Account, "rule", a.Rule, "error", err)
+			continue
+		}
+		sent = true
+	}
+	return sent
+}
@@ -0,0 +1,111 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"time"
+
+	"github.com/tracyhatemice/gomailify/internal/sender"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// Email sends alerts as plain-text messages through the SMTP relay.
+type Email struct {
+	sender *sender.Sender
+	to     string
+}
+
+// NewEmail returns a notifier that mails alerts to the address to.
+func NewEmail(s *sender.Sender, to string) *Email {
+	return &Email{sender: s, to: to}
+}
+
+// Notify implements Notifier.
+func (e *Email) Notify(ctx context.Context, a Alert) error {
+	var body bytes.Buffer
+	if a.Status == StatusResolved {
+		fmt.Fprintf(&body, "Account %s has recovered: %s.\r\n\r\n", a.Account, a.Summary)
+	} else {
+		fmt.Fprintf(&body, "Account %s needs attention: %s.\r\n\r\n", a.Account, a.Summary)
+		if a.Error != "" {
+			fmt.Fprintf(&body, "Last error: %s\r\n\r\n", a.Error)
+		}
+	}
+	fmt.Fprintf(&body, "Rule: %s\r\n", a.Rule)
+	fmt.Fprintf(&body, "Detected: %s\r\n", a.Since.Format(time.RFC1123Z))
+
+	subject := fmt.Sprintf("[gomailify] %s: %s", a.Account, a.Summary)
+	if a.Status == StatusResolved {
+		subject = fmt.Sprintf("[gomailify] RESOLVED %s: %s", a.Account, a.Summary)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", (&netmail.Address{Name: "gomailify", Address: e.sender.Address()}).String())
+	fmt.Fprintf(&msg, "To: %s\r\n", e.to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <alert-%s@gomailify>\r\n", rand.Text())
+	fmt.Fprintf(&msg, "X-Forwarded-By: gomailify\r\n")
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(body.Bytes())
+
+	if _, err := e.sender.Send(ctx, msg.Bytes(), e.to); err != nil {
+		return fmt.Errorf("mail alert to %s: %w", e.to, err)
+	}
+	return nil
+}
+
+// Webhook posts alerts as JSON. Besides the fields of Alert, the body has a
+// "text" field with a one-line summary, which chat services such as Slack
+// and Mattermost display as the message.
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhook returns a notifier that posts alerts to endpoint.
+func NewWebhook(endpoint string) *Webhook {
+	return &Webhook{url: endpoint, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Notify implements Notifier.
+func (w *Webhook) Notify(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(struct {
+		Alert
+		Text string `json:"text"`
+	}{a, a.Text()})
+	if err != nil {
+		return fmt.Errorf("encode alert: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("post alert: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// The URL often embeds a token; keep it out of the logs.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("post alert: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("post alert: webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+// Package audit records every message handed to the SMTP server in an
+// append-only JSON Lines file. Each record can carry the SHA-256 of the line
+// before it, so that editing, removing or reordering records breaks the
+// chain and is detected by Verify.
+package audit
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of Record.
+const (
+	KindMessage = "message" // one forwarded email
+	KindDigest  = "digest"  // a digest bundling several emails
+)
+
+// rotatedLayout names rotated files: the time of rotation is appended to the
+// path, and sorts in the order the files were written.
+const rotatedLayout = "20060102T150405.000Z"
+
+// genesis is the Prev of the first record of a hash-chained log.
+var genesis = strings.Repeat("0", sha256.Size*2)
+
+// Record is one line of the audit log.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Account   string    `json:"account"`
+	Kind      string    `json:"kind"`
+	ID        string    `json:"id,omitempty"`  // dedup key of a message
+	IDs       []string  `json:"ids,omitempty"` // dedup keys of the messages in a digest
+	MessageID string    `json:"message_id,omitempty"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	Subject   string    `json:"subject,omitempty"`
+	Size      int       `json:"size"`
+	Reply     string    `json:"reply"`              // final reply of the SMTP server to DATA
+	QueueID   string    `json:"queue_id,omitempty"` // queue ID found in Reply
+	Prev      string    `json:"prev,omitempty"`     // SHA-256 of the previous line, when hash-chained
+}
+
+// Log is an audit log file that is rotated when it grows past a size limit.
+// It is safe for concurrent use.
+type Log struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64 // bytes; 0 never rotates
+	maxBackups int   // 0 keeps all
+	chain      bool
+	f          *os.File
+	size       int64  // bytes of complete records in f
+	dirty      bool   // f holds part of a record past size, from a failed write
+	torn       int64  // bytes moved aside by Open
+	last       string // hash of the last line written, when chained
+}
+
+// TornPath returns the file that receives the incomplete records removed from
+// the audit log at path.
+func TornPath(path string) string {
+	return path + ".torn"
+}
+
+// Open opens or creates the audit log at path for appending. A record left
+// incomplete at the end of the file by a crash is first moved to TornPath, so
+// the next record does not continue it. With chain set, the first new record
+// is linked to the last one already in the log.
+func Open(path string, maxSize int64, maxBackups int, chain bool) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, maxBackups: maxBackups, chain: chain}
+	torn, err := dropTorn(path)
+	if err != nil {
+		return nil, err
+	}
+	l.torn = torn
+	if chain {
+		last, err := lastHash(path)
+		if err != nil {
+			return nil, err
+		}
+		l.last = cmp.Or(last, genesis)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Torn returns the number of bytes of an incomplete record that Open moved to
+// TornPath, or 0 if the log ended cleanly.
+func (l *Log) Torn() int64 {
+	return l.torn
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat audit log: %w", err)
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// Write appends rec to the log and syncs it to disk, first rotating the file
+// if rec would take it past the size limit. If the write fails part way, the
+// partial record is truncated away so the next one starts on a fresh line.
+func (l *Log) Write(rec Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.chain {
+		rec.Prev = l.last
+	} else {
+		rec.Prev = ""
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // keep <message-id@host> readable
+	if err := enc.Encode(rec); err != nil {
+		return fmt.Errorf("encode audit record: %w", err)
+	}
+	line := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	if l.dirty && l.f != nil {
+		if err := l.f.Truncate(l.size); err != nil {
+			return fmt.Errorf("remove incomplete audit record: %w", err)
+		}
+		l.dirty = false
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line))+1 > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate audit log: %w", err)
+		}
+	}
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(append(line, '\n'))
+	if err != nil {
+		if n > 0 {
+			if terr := l.f.Truncate(l.size); terr != nil {
+				l.dirty = true
+				err = errors.Join(err, terr)
+			}
+		}
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	l.size += int64(n)
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("sync audit log: %w", err)
+	}
+	if l.chain {
+		l.last = hash(line)
+	}
+	return nil
+}
+
+// rotate renames the current file after the time of rotation, removes the
+// oldest rotated files beyond the number of backups and reopens path.
+// l.mu must be held.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	name := l.path + "." + time.Now().UTC().Format(rotatedLayout)
+	if err := os.Rename(l.path, name); err != nil {
+		return err
+	}
+	if l.maxBackups > 0 {
+		rotated, err := rotatedFiles(l.path)
+		if err != nil {
+			return err
+		}
+		for len(rotated) > l.maxBackups {
+			if err := os.Remove(rotated[0]); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			rotated = rotated[1:]
+		}
+	}
+	return l.open()
+}
+
+// Close closes the file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Files returns the files of the audit log at path in the order they were
+// written: the rotated files, oldest first, then path itself if it exists.
+func Files(path string) ([]string, error) {
+	files, err := rotatedFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return files, nil
+}
+
+// rotatedFiles returns the rotated files of the audit log at path, oldest
+// first.
+func rotatedFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(globEscape(path) + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, m := range matches {
+		if _, err := time.Parse(rotatedLayout, strings.TrimPrefix(m, path+".")); err == nil {
+			files = append(files, m)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// globEscape quotes the glob metacharacters in path.
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// lastHash returns the hash of the last record in the audit log at path, or
+// "" if the log is empty.
+func lastHash(path string) (string, error) {
+	files, err := Files(path)
+	if err != nil {
+		return "", fmt.Errorf("list audit log files: %w", err)
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		line, err := lastLine(files[i])
+		if err != nil {
+			return "", fmt.Errorf("read audit log: %w", err)
+		}
+		if line != nil {
+			return hash(line), nil
+		}
+	}
+	return "", nil
+}
+
+// lastLine returns the last complete line of the file at name, without its
+// newline, or nil if there is none. It reads the file backwards from the end.
+func lastLine(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	for chunk := int64(4096); ; chunk *= 2 {
+		start := max(size-chunk, 0)
+		buf := make([]byte, size-start)
+		if _, err := f.ReadAt(buf, start); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		// A line not ending in a newline was cut short by a crash and is
+		// not part of the chain.
+		end := bytes.LastIndexByte(buf, '\n')
+		if end < 0 {
+			if start == 0 {
+				return nil, nil
+			}
+			continue
+		}
+		if i := bytes.LastIndexByte(buf[:end], '\n'); i >= 0 {
+			return buf[i+1 : end], nil
+		}
+		if start == 0 {
+			return buf[:end], nil
+		}
+	}
+}
+
+// dropTorn moves whatever follows the last newline of the file at path to
+// TornPath and truncates the file there, so the next record is not appended
+// to one a crash cut short. It returns the number of bytes moved.
+func dropTorn(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("open audit log: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat audit log: %w", err)
+	}
+
+	size := info.Size()
+	end := size
+	buf := make([]byte, 4096)
+	for end > 0 {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil && !errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("read audit log: %w", err)
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == size {
+		return 0, nil
+	}
+	if err := saveTorn(path, io.NewSectionReader(f, end, size-end)); err != nil {
+		return 0, fmt.Errorf("save incomplete audit record: %w", err)
+	}
+	if err := f.Truncate(end); err != nil {
+		return 0, fmt.Errorf("remove incomplete audit record: %w", err)
+	}
+	return size - end, f.Sync()
+}
+
+// saveTorn appends the incomplete record read from r, followed by a newline,
+// to TornPath(path) and syncs it.
+func saveTorn(path string, r io.Reader) error {
+	f, err := os.OpenFile(TornPath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write([]byte("\n")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hash returns the hex SHA-256 of line.
+func hash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
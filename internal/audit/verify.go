@@ -0,0 +1,83 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Summary describes an audit log checked by Verify.
+type Summary struct {
+	Records   int  // records read
+	Unchained int  // records written before hash chaining was enabled
+	Continued bool // the first chained record links to one no longer in the log, e.g. a removed rotated file
+}
+
+// Verify reads files in the order they were written, as returned by Files,
+// and checks that every record is well formed and, from the first
+// hash-chained record on, that each one carries the hash of the line before
+// it. It returns an error naming the first file and line that fail.
+func Verify(files []string) (Summary, error) {
+	var (
+		sum     Summary
+		prev    []byte // previous line
+		chained bool
+	)
+	for _, name := range files {
+		err := eachLine(name, func(n int, line []byte) error {
+			var rec Record
+			if err := json.Unmarshal(line, &rec); err != nil {
+				return fmt.Errorf("%s line %d: %w", name, n, err)
+			}
+			switch {
+			case rec.Prev == "" && chained:
+				return fmt.Errorf("%s line %d: record is not chained", name, n)
+			case rec.Prev == "":
+				sum.Unchained++
+			case prev == nil:
+				sum.Continued = rec.Prev != genesis
+			case rec.Prev != hash(prev):
+				return fmt.Errorf("%s line %d: chain broken: previous record was changed, removed or reordered", name, n)
+			}
+			chained = chained || rec.Prev != ""
+			prev = line
+			sum.Records++
+			return nil
+		})
+		if err != nil {
+			return sum, err
+		}
+	}
+	return sum, nil
+}
+
+// eachLine calls fn with each line of the file at name, numbered from 1 and
+// without its newline.
+func eachLine(name string, fn func(n int, line []byte) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				return fmt.Errorf("%s line %d: incomplete record", name, n)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		if err := fn(n, bytes.TrimSuffix(line, []byte("\n"))); err != nil {
+			return err
+		}
+	}
+}
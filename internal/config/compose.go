@@ -0,0 +1,408 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.yaml.in/yaml/v4"
+)
+
+// Keys that shape the account list and are resolved before decoding. They
+// never reach the Config struct.
+const (
+	keyInclude   = "include"
+	keyDefaults  = "defaults"
+	keyTemplates = "templates"
+	keyExtends   = "extends"
+	keyAccounts  = "accounts"
+)
+
+// imapOnlyKeys are account settings that apply to IMAP accounts only. Set
+// under defaults, they are not inherited by accounts of other protocols.
+var imapOnlyKeys = []string{"imap_folder", "use_idle"}
+
+// source is a YAML node together with the file it came from, for messages.
+// file is empty for the main configuration file.
+type source struct {
+	node *yaml.Node
+	file string
+}
+
+// problem reports msg at the position of n in file.
+func (s source) problem(n *yaml.Node, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if n != nil && n.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", n.Line, msg)
+	}
+	if s.file != "" {
+		msg = s.file + ": " + msg
+	}
+	return errors.New(msg)
+}
+
+// readNode parses the YAML file at path and returns its top-level mapping,
+// or nil if the file is empty.
+func readNode(path string) (*yaml.Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseNode(data)
+}
+
+// parseNode parses a YAML document and returns its top-level mapping, or nil
+// if the document is empty.
+func parseNode(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, decodeProblems(err)
+	}
+	root := &doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: top level must be a mapping", root.Line)
+	}
+	return root, nil
+}
+
+// compose resolves include, defaults, templates and extends in root, the
+// top-level mapping of the file at path, leaving a plain account list.
+//
+// Each account is built by merging, in order, the defaults, its template
+// chain from the outermost base down, and the account's own settings. Nested
+// mappings such as schedule are merged key by key; scalars and lists are
+// replaced as a whole by the later layer. IMAP-only settings in the defaults
+// are left out of accounts of other protocols.
+//
+// Included files, and every file in an included directory in name order,
+// may only contain accounts and templates. Their accounts are appended after
+// those of the main file in include order.
+func compose(root *yaml.Node, path string) Problems {
+	var problems Problems
+	main := source{node: root}
+
+	includes := takeKey(root, keyInclude)
+	defaults := takeKey(root, keyDefaults)
+	templatesNode := takeKey(root, keyTemplates)
+	accountsNode := lookupKey(root, keyAccounts)
+	for _, key := range []string{keyInclude, keyDefaults, keyTemplates} {
+		if i := indexKey(root, key); i >= 0 {
+			problems = append(problems, main.problem(root.Content[i], "%s is set more than once", key))
+			takeKey(root, key)
+		}
+	}
+
+	templates := make(map[string]source)
+	defined := make(map[string]source) // template name nodes, for duplicate reports
+	var accounts []source
+	addTemplates := func(src source) {
+		if src.node == nil {
+			return
+		}
+		if src.node.Kind != yaml.MappingNode {
+			problems = append(problems, src.problem(src.node, "templates must be a mapping of name to settings"))
+			return
+		}
+		for i := 0; i+1 < len(src.node.Content); i += 2 {
+			name, body := src.node.Content[i], src.node.Content[i+1]
+			if prev, dup := defined[name.Value]; dup {
+				problems = append(problems, src.problem(name, "template %q is already defined in %s", name.Value, describe(prev)))
+				continue
+			}
+			templates[name.Value] = source{node: body, file: src.file}
+			defined[name.Value] = source{node: name, file: src.file}
+		}
+	}
+	addAccounts := func(src source) {
+		if src.node == nil {
+			return
+		}
+		if src.node.Kind != yaml.SequenceNode {
+			problems = append(problems, src.problem(src.node, "accounts must be a list"))
+			return
+		}
+		for _, n := range src.node.Content {
+			accounts = append(accounts, source{node: n, file: src.file})
+		}
+	}
+
+	addTemplates(source{node: templatesNode})
+	addAccounts(source{node: accountsNode})
+
+	files, err := includeFiles(includes, filepath.Dir(path))
+	if err != nil {
+		problems = append(problems, main.problem(includes, "include: %v", err))
+	}
+	for _, file := range files {
+		inc, err := readNode(file)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		if inc == nil {
+			continue
+		}
+		src := source{node: inc, file: file}
+		for i := 0; i+1 < len(inc.Content); i += 2 {
+			switch key := inc.Content[i]; key.Value {
+			case keyAccounts:
+				addAccounts(source{node: inc.Content[i+1], file: file})
+			case keyTemplates:
+				addTemplates(source{node: inc.Content[i+1], file: file})
+			default:
+				problems = append(problems, src.problem(key, "%s cannot be set in an included file, only accounts and templates", key.Value))
+			}
+		}
+	}
+
+	// Check each layer on its own first, so a problem is reported once and
+	// in the file where it was written, not in every account inheriting it.
+	if defaults != nil {
+		problems = append(problems, checkLayer(source{node: defaults}, false)...)
+	}
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, checkLayer(templates[name], true)...)
+	}
+	for _, acct := range accounts {
+		problems = append(problems, checkLayer(acct, true)...)
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	resolved := make(map[string]*yaml.Node)
+	var resolve func(name string, from source, at *yaml.Node, chain []string) (*yaml.Node, error)
+	resolve = func(name string, from source, at *yaml.Node, chain []string) (*yaml.Node, error) {
+		if n, ok := resolved[name]; ok {
+			return n, nil
+		}
+		tmpl, ok := templates[name]
+		if !ok {
+			return nil, from.problem(at, "unknown template %q", name)
+		}
+		for _, c := range chain {
+			if c == name {
+				return nil, from.problem(at, "template cycle: %s -> %s", strings.Join(chain, " -> "), name)
+			}
+		}
+		merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		if parent := lookupKey(tmpl.node, keyExtends); parent != nil {
+			base, err := resolve(parent.Value, tmpl, parent, append(chain, name))
+			if err != nil {
+				return nil, err
+			}
+			merged = base
+		}
+		merged = mergeNodes(merged, withoutKey(tmpl.node, keyExtends))
+		resolved[name] = merged
+		return merged, nil
+	}
+
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, acct := range accounts {
+		own := withoutKey(acct.node, keyExtends)
+		if ext := lookupKey(acct.node, keyExtends); ext != nil {
+			tmpl, err := resolve(ext.Value, acct, ext, nil)
+			if err != nil {
+				problems = append(problems, err)
+				continue
+			}
+			own = mergeNodes(tmpl, own)
+		}
+		if defaults == nil {
+			seq.Content = append(seq.Content, own)
+			continue
+		}
+		merged := mergeNodes(defaults, own)
+		if p := lookupKey(merged, "protocol"); p == nil || p.Value != "imap" {
+			base := defaults
+			for _, key := range imapOnlyKeys {
+				base = withoutKey(base, key)
+			}
+			merged = mergeNodes(base, own)
+		}
+		seq.Content = append(seq.Content, merged)
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	if accountsNode != nil {
+		*accountsNode = *seq
+	} else if len(seq.Content) > 0 {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: keyAccounts}, seq)
+	}
+	return nil
+}
+
+// checkLayer decodes one defaults, template or account mapping on its own,
+// reporting unknown keys and type errors in its file.
+func checkLayer(src source, extendable bool) Problems {
+	n := resolveAlias(src.node)
+	if n.Kind != yaml.MappingNode {
+		return Problems{src.problem(n, "expected a mapping of account settings")}
+	}
+	if extendable {
+		if ext := lookupKey(n, keyExtends); ext != nil && (ext.Kind != yaml.ScalarNode || ext.Value == "") {
+			return Problems{src.problem(ext, "extends must be a template name")}
+		}
+		n = withoutKey(n, keyExtends)
+	}
+	var acct Account
+	err := n.Load(&acct, yaml.WithV3Defaults(), yaml.WithKnownFields())
+	if err == nil {
+		return nil
+	}
+	var errs *yaml.LoadErrors
+	if !errors.As(err, &errs) {
+		return Problems{src.problem(nil, "%v", err)}
+	}
+	var problems Problems
+	for _, e := range errs.Errors {
+		problems = append(problems, src.problem(&yaml.Node{Line: e.Mark.Line}, "%s", e.Message))
+	}
+	return problems
+}
+
+// includeFiles expands the include setting, a pattern or a list of them, into
+// file names. Patterns are relative to dir. A directory stands for every
+// .yaml and .yml file in it. Each pattern's matches are sorted by name.
+func includeFiles(include *yaml.Node, dir string) ([]string, error) {
+	if include == nil {
+		return nil, nil
+	}
+	var patterns []string
+	switch include.Kind {
+	case yaml.ScalarNode:
+		patterns = []string{include.Value}
+	case yaml.SequenceNode:
+		for _, n := range include.Content {
+			if n.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: expected a file, directory or glob pattern", n.Line)
+			}
+			patterns = append(patterns, n.Value)
+		}
+	default:
+		return nil, errors.New("expected a file, directory or glob pattern, or a list of them")
+	}
+
+	var files []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+			var matches []string
+			for _, ext := range []string{"*.yaml", "*.yml"} {
+				m, _ := filepath.Glob(filepath.Join(pattern, ext))
+				matches = append(matches, m...)
+			}
+			sort.Strings(matches)
+			files = append(files, matches...)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no such file", pattern)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// mergeNodes returns a new mapping with the entries of over laid on top of
+// base. Where both hold a mapping for the same key they are merged in turn;
+// any other value in over replaces the one in base.
+func mergeNodes(base, over *yaml.Node) *yaml.Node {
+	base, over = resolveAlias(base), resolveAlias(over)
+	out := *base
+	out.Content = append([]*yaml.Node(nil), base.Content...)
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		key, val := over.Content[i], over.Content[i+1]
+		j := indexKey(&out, key.Value)
+		switch {
+		case j < 0:
+			out.Content = append(out.Content, key, val)
+		case resolveAlias(out.Content[j+1]).Kind == yaml.MappingNode && resolveAlias(val).Kind == yaml.MappingNode:
+			out.Content[j+1] = mergeNodes(out.Content[j+1], val)
+		default:
+			out.Content[j+1] = val
+		}
+	}
+	return &out
+}
+
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// indexKey returns the index of key's key node in mapping m, or -1.
+func indexKey(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookupKey returns the value of key in mapping m, or nil.
+func lookupKey(m *yaml.Node, key string) *yaml.Node {
+	m = resolveAlias(m)
+	if i := indexKey(m, key); i >= 0 {
+		return m.Content[i+1]
+	}
+	return nil
+}
+
+// takeKey removes key from mapping m and returns its value, or nil.
+func takeKey(m *yaml.Node, key string) *yaml.Node {
+	i := indexKey(m, key)
+	if i < 0 {
+		return nil
+	}
+	val := m.Content[i+1]
+	m.Content = append(m.Content[:i], m.Content[i+2:]...)
+	return val
+}
+
+// withoutKey returns a copy of mapping m without key.
+func withoutKey(m *yaml.Node, key string) *yaml.Node {
+	m = resolveAlias(m)
+	out := *m
+	out.Content = append([]*yaml.Node(nil), m.Content...)
+	takeKey(&out, key)
+	return &out
+}
+
+// describe names where a source was defined, for duplicate reports.
+func describe(s source) string {
+	file := s.file
+	if file == "" {
+		file = "the main file"
+	}
+	return fmt.Sprintf("%s at line %d", file, s.node.Line)
+}
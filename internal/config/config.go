@@ -1,27 +1,226 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"go.yaml.in/yaml/v4"
+
+	"github.com/tracyhatemice/gomailify/internal/schedule"
+)
+
+// Delivery modes for Account.Delivery.
+const (
+	DeliveryImmediate = "immediate"
+	DeliveryDigest    = "digest"
+)
+
+// Dedup key strategies for Account.DedupKey.
+const (
+	DedupKeyMessageID   = "message_id"
+	DedupKeyUID         = "uid"
+	DedupKeyContentHash = "content_hash"
+)
+
+// Dedup scopes for Dedup.Scope.
+const (
+	ScopeAccount     = "account"
+	ScopeDestination = "destination"
 )
 
 // Config is the top-level application configuration.
 type Config struct {
-	LogLevel string     `yaml:"log_level"`
-	Sender   SMTP       `yaml:"sender"`
-	Accounts []Account  `yaml:"accounts"`
+	LogLevel  string    `yaml:"log_level"`
+	LogFormat string    `yaml:"log_format"` // "text" (default) or "json"
+	LogFile   LogFile   `yaml:"log_file"`
+	Sender    SMTP      `yaml:"sender"`
+	Dedup     Dedup     `yaml:"dedup"`
+	HTTP      HTTP      `yaml:"http"`
+	Tracing   Tracing   `yaml:"tracing"`
+	Alerts    Alerts    `yaml:"alerts"`
+	Audit     Audit     `yaml:"audit"`
+	Accounts  []Account `yaml:"accounts"`
+}
+
+// Alerts configures notifications about accounts that stop working. They are
+// sent when Email or Webhook is set.
+type Alerts struct {
+	Email           string `yaml:"email"`            // send alerts through the sender to this address
+	Webhook         string `yaml:"webhook"`          // POST alerts as JSON to this URL
+	WebhookFile     string `yaml:"webhook_file"`     // read Webhook from this file instead
+	FetchFailures   int    `yaml:"fetch_failures"`   // consecutive failed mailbox checks; defaults to 3, -1 disables
+	AuthFailures    *bool  `yaml:"auth_failures"`    // alert on the first rejected login; defaults to true
+	NoSyncHours     int    `yaml:"no_sync_hours"`    // hours without a successful check; defaults to 24, -1 disables
+	ForwardFailures int    `yaml:"forward_failures"` // consecutive failed deliveries still being retried; defaults to 3, -1 disables
+	RepeatHours     int    `yaml:"repeat_hours"`     // remind of an unresolved alert after this long; defaults to 24, -1 never
+}
+
+// Enabled reports whether alerts are sent anywhere.
+func (a *Alerts) Enabled() bool {
+	return a.Email != "" || a.Webhook != ""
+}
+
+// GetFetchFailures returns the number of consecutive failed mailbox checks
+// that raise an alert, or 0 if the rule is disabled.
+func (a *Alerts) GetFetchFailures() int {
+	return alertThreshold(a.FetchFailures, 3)
+}
+
+// GetAuthFailures reports whether a rejected login raises an alert.
+func (a *Alerts) GetAuthFailures() bool {
+	return a.AuthFailures == nil || *a.AuthFailures
+}
+
+// GetNoSync returns how long an account may go without a successful mailbox
+// check before an alert is raised, or 0 if the rule is disabled.
+func (a *Alerts) GetNoSync() time.Duration {
+	return time.Duration(alertThreshold(a.NoSyncHours, 24)) * time.Hour
+}
+
+// GetForwardFailures returns the number of consecutive failed deliveries
+// that raise an alert, or 0 if the rule is disabled.
+func (a *Alerts) GetForwardFailures() int {
+	return alertThreshold(a.ForwardFailures, 3)
+}
+
+// GetRepeat returns how often an unresolved alert is sent again, or 0 for
+// never.
+func (a *Alerts) GetRepeat() time.Duration {
+	return time.Duration(alertThreshold(a.RepeatHours, 24)) * time.Hour
+}
+
+// alertThreshold applies the default to an unset setting and maps -1 to 0.
+func alertThreshold(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return max(v, 0)
+}
+
+// Tracing configures export of OpenTelemetry traces of the fetch and forward
+// pipeline.
+type Tracing struct {
+	Exporter string `yaml:"exporter"` // "otlp" or "stdout"; empty disables tracing
+	Endpoint string `yaml:"endpoint"` // OTLP/HTTP collector URL; defaults to the OTEL_EXPORTER_OTLP_* variables
+}
+
+// LogFile configures logging to a file instead of stderr.
+type LogFile struct {
+	Path       string `yaml:"path"`        // empty logs to stderr
+	MaxSizeMB  int    `yaml:"max_size_mb"` // rotate once the file reaches this size; defaults to 10
+	MaxBackups int    `yaml:"max_backups"` // rotated files kept; defaults to 3, -1 keeps none
+}
+
+// GetMaxSize returns the size in bytes at which the log file is rotated.
+func (l *LogFile) GetMaxSize() int64 {
+	if l.MaxSizeMB == 0 {
+		return 10 << 20
+	}
+	return int64(l.MaxSizeMB) << 20
+}
+
+// GetMaxBackups returns the number of rotated log files kept.
+func (l *LogFile) GetMaxBackups() int {
+	if l.MaxBackups == 0 {
+		return 3
+	}
+	return max(l.MaxBackups, 0)
+}
+
+// Audit configures the audit log, a record of every message accepted by the
+// SMTP server.
+type Audit struct {
+	Path       string `yaml:"path"`        // JSON Lines file; empty disables the audit log
+	MaxSizeMB  int    `yaml:"max_size_mb"` // rotate once the file reaches this size; defaults to 100, -1 never rotates
+	MaxBackups int    `yaml:"max_backups"` // rotated files kept; 0 (the default) keeps all
+	HashChain  bool   `yaml:"hash_chain"`  // link each record to the previous one by its SHA-256
+}
+
+// GetMaxSize returns the size in bytes at which the audit log is rotated, or
+// 0 if it is never rotated.
+func (a *Audit) GetMaxSize() int64 {
+	if a.MaxSizeMB == 0 {
+		return 100 << 20
+	}
+	return int64(max(a.MaxSizeMB, 0)) << 20
+}
+
+// HTTP configures the optional HTTP listener that serves metrics, health
+// checks and the admin API.
+type HTTP struct {
+	Listen         string `yaml:"listen"`           // address such as ":9090"; empty disables the listener
+	AdminToken     string `yaml:"admin_token"`      // bearer token for the admin API; empty disables the API
+	AdminTokenFile string `yaml:"admin_token_file"` // read AdminToken from this file instead
+}
+
+// Dedup configures how forwarded message IDs are stored.
+type Dedup struct {
+	Backend       string `yaml:"backend"`         // "bolt" (default) or "file"
+	RetentionDays int    `yaml:"retention_days"`  // days kept beyond process_days; defaults to 30, -1 keeps forever
+	GroupCommitMS int    `yaml:"group_commit_ms"` // file backend: share one fsync across writes within this window
+	Scope         string `yaml:"scope"`           // "account" (default) or "destination" to also dedup across accounts
+}
+
+// GroupCommit returns the file backend's group-commit window.
+func (d *Dedup) GroupCommit() time.Duration {
+	return time.Duration(d.GroupCommitMS) * time.Millisecond
+}
+
+// GetBackend returns the storage backend, defaulting to "bolt".
+func (d *Dedup) GetBackend() string {
+	if d.Backend == "" {
+		return "bolt"
+	}
+	return d.Backend
+}
+
+// GetScope returns the dedup scope, defaulting to "account".
+func (d *Dedup) GetScope() string {
+	if d.Scope == "" {
+		return ScopeAccount
+	}
+	return d.Scope
+}
+
+// Retention returns how long an account's IDs are kept before pruning:
+// its process_days window plus retention_days. Zero means keep forever.
+func (d *Dedup) Retention(a *Account) time.Duration {
+	days := d.RetentionDays
+	switch {
+	case days < 0:
+		return 0
+	case days == 0:
+		days = 30
+	}
+	return time.Duration(a.GetProcessDays()+days) * 24 * time.Hour
 }
 
 // SMTP holds the outgoing mail server configuration.
 type SMTP struct {
-	Host     string `yaml:"host"`
-	Port     int    `yaml:"port"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	UseTLS   bool   `yaml:"use_tls"`
+	Host                 string    `yaml:"host"`
+	Port                 int       `yaml:"port"`
+	Username             string    `yaml:"username"`
+	UsernameFile         string    `yaml:"username_file"` // read username from this file instead
+	Password             string    `yaml:"password"`
+	PasswordFile         string    `yaml:"password_file"` // read password from this file instead
+	UseTLS               bool      `yaml:"use_tls"`
+	From                 string    `yaml:"from"`                   // author of digests and alert emails; defaults to username
+	RateLimit            RateLimit `yaml:"rate_limit"`             // applies to all forwarded mail
+	DestinationRateLimit RateLimit `yaml:"destination_rate_limit"` // applies per forward_to address
+}
+
+// RateLimit is a token-bucket limit on outgoing mail. Zero disables a field.
+type RateLimit struct {
+	MessagesPerMinute int   `yaml:"messages_per_minute"`
+	BytesPerHour      int64 `yaml:"bytes_per_hour"`
 }
 
 // Account describes one monitored email account.
@@ -31,13 +230,58 @@ type Account struct {
 	Host                 string `yaml:"host"`
 	Port                 int    `yaml:"port"`
 	Username             string `yaml:"username"`
+	UsernameFile         string `yaml:"username_file"` // read username from this file instead
 	Password             string `yaml:"password"`
+	PasswordFile         string `yaml:"password_file"` // read password from this file instead
 	UseTLS               bool   `yaml:"use_tls"`
 	ForwardTo            string `yaml:"forward_to"`
 	CheckIntervalSeconds int    `yaml:"check_interval_seconds"`
 	ProcessDays          int    `yaml:"process_days"`
 	IMAPFolder           string `yaml:"imap_folder"`
-	UseIdle              *bool  `yaml:"use_idle"` // IMAP only; defaults to true
+	UseIdle              *bool  `yaml:"use_idle"`        // IMAP only; defaults to true
+	Delivery             string `yaml:"delivery"`        // "immediate" (default) or "digest"
+	DigestSchedule       string `yaml:"digest_schedule"` // cron expression; defaults to daily at 08:00
+
+	Schedule *DeliverySchedule `yaml:"schedule"` // optional delivery windows; mail outside them is held
+	DryRun   bool              `yaml:"dry_run"`  // log what would be forwarded without sending or marking seen
+
+	BaselineOnFirstRun bool `yaml:"baseline_on_first_run"` // mark existing mail seen when no dedup state exists yet
+	MaxAttempts        int  `yaml:"max_attempts"`          // delivery attempts before a message is dead-lettered; defaults to 5
+
+	DedupKey string `yaml:"dedup_key"` // "message_id" (default), "uid" or "content_hash"
+	LogLevel string `yaml:"log_level"` // overrides the global log_level for this account's records
+}
+
+// DeliverySchedule restricts forwarding to windows of the week. Mail fetched
+// outside every window is held until the next one opens, unless it matches
+// one of the Urgent rules.
+type DeliverySchedule struct {
+	Timezone string       `yaml:"timezone"` // IANA zone, e.g. "Europe/Berlin"; defaults to local time
+	Windows  []Window     `yaml:"windows"`
+	Urgent   []UrgentRule `yaml:"urgent"`
+}
+
+// Window is one weekly delivery window. End at or before Start spans midnight.
+type Window struct {
+	Days  []string `yaml:"days"`  // e.g. [mon, tue, wed]; empty means every day
+	Start string   `yaml:"start"` // "HH:MM"
+	End   string   `yaml:"end"`   // "HH:MM"
+}
+
+// UrgentRule selects messages that bypass the delivery schedule. Each field is
+// a regular expression; all non-empty fields must match.
+type UrgentRule struct {
+	From    string `yaml:"from"`
+	Subject string `yaml:"subject"`
+}
+
+// Hours returns the parsed delivery windows.
+func (d *DeliverySchedule) Hours() (*schedule.Hours, error) {
+	spans := make([]schedule.Span, 0, len(d.Windows))
+	for _, w := range d.Windows {
+		spans = append(spans, schedule.Span{Days: w.Days, Start: w.Start, End: w.End})
+	}
+	return schedule.NewHours(d.Timezone, spans)
 }
 
 // CheckInterval returns the check interval as a time.Duration.
@@ -72,7 +316,64 @@ func (a *Account) GetIMAPFolder() string {
 	return a.IMAPFolder
 }
 
-// Load reads and parses a YAML configuration file.
+// GetMaxAttempts returns how many times delivery of one message is attempted
+// before it is dead-lettered, defaulting to 5. Negative values retry forever.
+func (a *Account) GetMaxAttempts() int {
+	if a.MaxAttempts == 0 {
+		return 5
+	}
+	return max(a.MaxAttempts, 0)
+}
+
+// GetDedupKey returns the dedup key strategy, defaulting to "message_id".
+func (a *Account) GetDedupKey() string {
+	if a.DedupKey == "" {
+		return DedupKeyMessageID
+	}
+	return a.DedupKey
+}
+
+// GetDelivery returns the delivery mode, defaulting to "immediate".
+func (a *Account) GetDelivery() string {
+	if a.Delivery == "" {
+		return DeliveryImmediate
+	}
+	return a.Delivery
+}
+
+// GetDigestSchedule returns the digest cron expression, defaulting to daily at 08:00.
+func (a *Account) GetDigestSchedule() string {
+	if a.DigestSchedule == "" {
+		return "0 8 * * *"
+	}
+	return a.DigestSchedule
+}
+
+// Problems lists everything wrong with a configuration. Load returns it,
+// wrapped, so that all problems can be fixed in one go.
+type Problems []error
+
+func (p Problems) Error() string {
+	if len(p) == 1 {
+		return p[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d problems:", len(p))
+	for _, err := range p {
+		b.WriteString("\n  - ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+func (p Problems) Unwrap() []error {
+	return p
+}
+
+// Load reads and parses a YAML configuration file. Unknown keys are rejected,
+// so that a misspelt setting is not silently replaced by its default.
+// Included files are read and defaults and templates applied to the accounts
+// before they are decoded; see compose.
 func Load(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -82,43 +383,318 @@ func Load(path string) (*Config, error) {
 	cfg := &Config{
 		LogLevel: "info",
 	}
-	if err := yaml.Unmarshal(data, cfg); err != nil {
+	root, err := parseNode(data)
+	if err != nil {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
+	if root != nil {
+		if problems := compose(root, path); len(problems) > 0 {
+			return nil, fmt.Errorf("parse config: %w", problems)
+		}
+		if err := root.Load(cfg, yaml.WithV3Defaults(), yaml.WithKnownFields()); err != nil {
+			return nil, fmt.Errorf("parse config: %w", decodeProblems(err))
+		}
+	}
 
-	if err := cfg.validate(); err != nil {
-		return nil, fmt.Errorf("validate config: %w", err)
+	problems := cfg.resolveSecrets(filepath.Dir(path))
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("validate config: %w", problems)
 	}
 	return cfg, nil
 }
 
-func (c *Config) validate() error {
+// decodeProblems splits a YAML decoding error into one problem per field,
+// each with its line number.
+func decodeProblems(err error) error {
+	var errs *yaml.LoadErrors
+	if !errors.As(err, &errs) {
+		return err
+	}
+	problems := make(Problems, 0, len(errs.Errors))
+	for _, e := range errs.Errors {
+		if e.Mark.Line > 0 {
+			problems = append(problems, fmt.Errorf("line %d: %s", e.Mark.Line, e.Message))
+		} else {
+			problems = append(problems, errors.New(e.Message))
+		}
+	}
+	return problems
+}
+
+// validate returns every problem found in c.
+func (c *Config) validate() Problems {
+	var problems Problems
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if !validLogLevel(c.LogLevel) {
+		add("log_level must be debug, info, warn or error")
+	}
+	switch c.LogFormat {
+	case "", "text", "json":
+	default:
+		add("log_format must be text or json")
+	}
+	if c.LogFile.MaxSizeMB < 0 {
+		add("log_file.max_size_mb must not be negative")
+	}
+	if c.LogFile.MaxBackups < -1 {
+		add("log_file.max_backups must be -1 (keep none) or more")
+	}
+	if c.LogFile.Path == "" && (c.LogFile.MaxSizeMB != 0 || c.LogFile.MaxBackups != 0) {
+		add("log_file settings require log_file.path")
+	}
+
 	if c.Sender.Host == "" {
-		return fmt.Errorf("sender.host is required")
+		add("sender.host is required")
+	}
+	if err := validatePort(c.Sender.Port); err != nil {
+		add("sender.port %w", err)
+	}
+	if c.Sender.From != "" {
+		if addr, err := mail.ParseAddress(c.Sender.From); err != nil || addr.Name != "" || addr.Address != c.Sender.From {
+			add("sender.from %q must be a plain email address such as gomailify@example.com", c.Sender.From)
+		}
+	} else if c.Alerts.Email != "" && c.Sender.Username == "" {
+		add("sender.from or sender.username is required to send alerts.email")
+	}
+	if err := c.Sender.RateLimit.validate(); err != nil {
+		add("sender.rate_limit: %w", err)
+	}
+	if err := c.Sender.DestinationRateLimit.validate(); err != nil {
+		add("sender.destination_rate_limit: %w", err)
+	}
+
+	if b := c.Dedup.GetBackend(); b != "bolt" && b != "file" {
+		add("dedup.backend must be bolt or file")
+	}
+	if c.Dedup.GroupCommitMS < 0 {
+		add("dedup.group_commit_ms must not be negative")
+	} else if c.Dedup.GroupCommitMS > 0 && c.Dedup.GetBackend() != "file" {
+		add("dedup.group_commit_ms applies to the file backend only")
+	}
+	if c.Dedup.RetentionDays < -1 {
+		add("dedup.retention_days must be -1 (keep forever) or more")
+	}
+	if s := c.Dedup.GetScope(); s != ScopeAccount && s != ScopeDestination {
+		add("dedup.scope must be account or destination")
+	}
+	if c.Audit.MaxSizeMB < -1 {
+		add("audit.max_size_mb must be -1 (never rotate) or more")
+	}
+	if c.Audit.MaxBackups < 0 {
+		add("audit.max_backups must not be negative")
+	}
+	if c.Audit.Path == "" && c.Audit != (Audit{}) {
+		add("audit settings require audit.path")
+	}
+	if c.HTTP.Listen != "" {
+		if _, port, err := net.SplitHostPort(c.HTTP.Listen); err != nil || port == "" {
+			add("http.listen must be host:port or :port")
+		}
+	}
+	if c.HTTP.AdminToken != "" && c.HTTP.Listen == "" {
+		add("http.admin_token requires http.listen")
+	}
+	if c.Alerts.Email != "" {
+		if addr, err := mail.ParseAddress(c.Alerts.Email); err != nil || addr.Name != "" || addr.Address != c.Alerts.Email {
+			add("alerts.email %q must be a plain email address such as admin@example.com", c.Alerts.Email)
+		}
+	}
+	if c.Alerts.Webhook != "" {
+		if u, err := url.Parse(c.Alerts.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("alerts.webhook must be an http or https URL")
+		}
+	}
+	for _, v := range []struct {
+		key string
+		n   int
+	}{
+		{"fetch_failures", c.Alerts.FetchFailures},
+		{"no_sync_hours", c.Alerts.NoSyncHours},
+		{"forward_failures", c.Alerts.ForwardFailures},
+		{"repeat_hours", c.Alerts.RepeatHours},
+	} {
+		if v.n < -1 {
+			add("alerts.%s must be -1 (disabled) or more", v.key)
+		}
 	}
-	if c.Sender.Port == 0 {
-		return fmt.Errorf("sender.port is required")
+	switch c.Tracing.Exporter {
+	case "", "otlp", "stdout":
+	default:
+		add("tracing.exporter must be otlp or stdout")
 	}
+	if c.Tracing.Endpoint != "" {
+		if c.Tracing.Exporter != "otlp" {
+			add("tracing.endpoint applies to the otlp exporter only")
+		} else if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("tracing.endpoint must be an http or https URL such as http://collector:4318")
+		}
+	}
+
 	if len(c.Accounts) == 0 {
-		return fmt.Errorf("at least one account is required")
+		add("at least one account is required")
 	}
+	// Accounts are told apart by the name of their state files, so names
+	// that differ only in characters replaced there collide too.
+	names := make(map[string]int, len(c.Accounts))
+	stateNames := make(map[string]int, len(c.Accounts))
 	for i, a := range c.Accounts {
 		label := a.Name
 		if label == "" {
 			label = fmt.Sprintf("#%d", i)
 		}
-		if a.Protocol != "pop3" && a.Protocol != "imap" {
-			return fmt.Errorf("account %s: protocol must be pop3 or imap", label)
+		if first, dup := names[a.Name]; dup {
+			if a.Name == "" {
+				add("accounts #%d and #%d both have no name; names must be unique", first, i)
+			} else {
+				add("accounts #%d and #%d are both named %q; names must be unique", first, i, a.Name)
+			}
+		} else {
+			names[a.Name] = i
+			if first, dup := stateNames[StateName(a.Name)]; dup {
+				add("accounts #%d (%q) and #%d (%q) would share the state file %q; rename one of them",
+					first, c.Accounts[first].Name, i, a.Name, StateName(a.Name))
+			} else {
+				stateNames[StateName(a.Name)] = i
+			}
+		}
+		for _, err := range a.validate() {
+			add("account %s: %w", label, err)
+		}
+		if a.GetDelivery() == DeliveryDigest && c.Sender.From == "" && c.Sender.Username == "" {
+			add("account %s: delivery: digest requires sender.from or sender.username", label)
+		}
+	}
+	return problems
+}
+
+// StateName returns the name under which the state of the account called name
+// is stored: name with every character other than ASCII letters, digits, '-'
+// and '_' replaced by '_', or "default" for an empty name.
+func StateName(name string) string {
+	if name == "" {
+		return "default"
+	}
+	out := make([]byte, 0, len(name))
+	for _, b := range []byte(name) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '-' || b == '_' {
+			out = append(out, b)
+		} else {
+			out = append(out, '_')
+		}
+	}
+	return string(out)
+}
+
+func validLogLevel(level string) bool {
+	switch level {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
+
+// validate returns every problem found in a.
+func (a *Account) validate() Problems {
+	var problems Problems
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	switch a.Protocol {
+	case "imap":
+	case "pop3":
+		if a.IMAPFolder != "" {
+			add("imap_folder applies to imap accounts only")
+		}
+		if a.UseIdle != nil {
+			add("use_idle applies to imap accounts only")
 		}
-		if a.Host == "" {
-			return fmt.Errorf("account %s: host is required", label)
+	default:
+		add("protocol must be pop3 or imap")
+	}
+	if a.Host == "" {
+		add("host is required")
+	}
+	if err := validatePort(a.Port); err != nil {
+		add("port %w", err)
+	}
+	if a.ForwardTo == "" {
+		add("forward_to is required")
+	} else if addr, err := mail.ParseAddress(a.ForwardTo); err != nil || addr.Name != "" || addr.Address != a.ForwardTo {
+		add("forward_to %q must be a plain email address such as user@example.com", a.ForwardTo)
+	}
+	if a.CheckIntervalSeconds < 0 {
+		add("check_interval_seconds must not be negative")
+	}
+	if a.ProcessDays < 0 {
+		add("process_days must not be negative")
+	}
+
+	if a.LogLevel != "" && !validLogLevel(a.LogLevel) {
+		add("log_level must be debug, info, warn or error")
+	}
+	switch a.GetDedupKey() {
+	case DedupKeyMessageID, DedupKeyUID, DedupKeyContentHash:
+	default:
+		add("dedup_key must be message_id, uid or content_hash")
+	}
+	switch a.GetDelivery() {
+	case DeliveryImmediate:
+		if a.DigestSchedule != "" {
+			add("digest_schedule requires delivery: digest")
 		}
-		if a.Port == 0 {
-			return fmt.Errorf("account %s: port is required", label)
+	case DeliveryDigest:
+		if _, err := schedule.ParseCron(a.GetDigestSchedule()); err != nil {
+			add("digest_schedule: %w", err)
 		}
-		if a.ForwardTo == "" {
-			return fmt.Errorf("account %s: forward_to is required", label)
+	default:
+		add("delivery must be immediate or digest")
+	}
+
+	if a.Schedule != nil {
+		if a.GetDelivery() == DeliveryDigest {
+			add("schedule cannot be combined with delivery: digest")
 		}
+		if _, err := a.Schedule.Hours(); err != nil {
+			add("schedule: %w", err)
+		}
+		for j, r := range a.Schedule.Urgent {
+			if r.From == "" && r.Subject == "" {
+				add("schedule.urgent[%d]: from or subject is required", j)
+			}
+			if _, err := regexp.Compile(r.From); err != nil {
+				add("schedule.urgent[%d].from: %w", j, err)
+			}
+			if _, err := regexp.Compile(r.Subject); err != nil {
+				add("schedule.urgent[%d].subject: %w", j, err)
+			}
+		}
+	}
+	return problems
+}
+
+// validatePort returns an error, meant to follow the setting's name, if port
+// is missing or out of range.
+func validatePort(port int) error {
+	switch {
+	case port == 0:
+		return errors.New("is required")
+	case port < 1 || port > 65535:
+		return fmt.Errorf("%d is out of range 1-65535", port)
+	}
+	return nil
+}
+
+func (r RateLimit) validate() error {
+	if r.MessagesPerMinute < 0 {
+		return fmt.Errorf("messages_per_minute must not be negative")
+	}
+	if r.BytesPerHour < 0 {
+		return fmt.Errorf("bytes_per_hour must not be negative")
 	}
 	return nil
 }
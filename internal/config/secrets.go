@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolveSecrets fills in every credential from its *_file setting and
+// expands ${VAR} references to environment variables, returning a problem for
+// each credential that cannot be resolved. Relative file paths are resolved
+// against dir, the directory of the configuration file.
+func (c *Config) resolveSecrets(dir string) Problems {
+	var problems Problems
+	if err := resolveCredential(&c.Sender.Username, c.Sender.UsernameFile, dir); err != nil {
+		problems = append(problems, fmt.Errorf("sender.username: %w", err))
+	}
+	if err := resolveCredential(&c.Sender.Password, c.Sender.PasswordFile, dir); err != nil {
+		problems = append(problems, fmt.Errorf("sender.password: %w", err))
+	}
+	if err := resolveCredential(&c.HTTP.AdminToken, c.HTTP.AdminTokenFile, dir); err != nil {
+		problems = append(problems, fmt.Errorf("http.admin_token: %w", err))
+	}
+	if err := resolveCredential(&c.Alerts.Webhook, c.Alerts.WebhookFile, dir); err != nil {
+		problems = append(problems, fmt.Errorf("alerts.webhook: %w", err))
+	}
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		label := a.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i)
+		}
+		if err := resolveCredential(&a.Username, a.UsernameFile, dir); err != nil {
+			problems = append(problems, fmt.Errorf("account %s: username: %w", label, err))
+		}
+		if err := resolveCredential(&a.Password, a.PasswordFile, dir); err != nil {
+			problems = append(problems, fmt.Errorf("account %s: password: %w", label, err))
+		}
+	}
+	return problems
+}
+
+// resolveCredential sets *value from file, if given, and then expands
+// environment variable references in it. Setting both a value and a file is
+// an error, since it is unclear which was meant.
+func resolveCredential(value *string, file, dir string) error {
+	if file != "" {
+		if *value != "" {
+			return fmt.Errorf("set either the value or the _file variant, not both")
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("read secret file: %w", err)
+		}
+		// Secret files written by editors or `echo` end in a newline.
+		*value = strings.TrimRight(string(data), "\r\n")
+		return nil
+	}
+
+	expanded, err := expandEnv(*value)
+	if err != nil {
+		return err
+	}
+	*value = expanded
+	return nil
+}
+
+// expandEnv replaces each ${VAR} in s with the value of the environment
+// variable VAR, failing if it is not set. A bare $ is left alone so that
+// passwords containing one need no escaping; "$${" yields a literal "${".
+func expandEnv(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i])
+			b.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in value")
+		}
+		name := s[i+2 : i+end]
+		if name == "" {
+			return "", fmt.Errorf("empty variable name in ${}")
+		}
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(s[:i])
+		b.WriteString(val)
+		s = s[i+end+1:]
+	}
+}
@@ -0,0 +1,22 @@
+// Package dashboard serves a small web page that shows the state of every
+// account and offers the common admin actions. The page is static; it talks
+// to the admin API with the token the user enters.
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard page and its assets.
+func Handler() http.Handler {
+	sub, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err) // the embedded tree is fixed at build time
+	}
+	return http.FileServerFS(sub)
+}
@@ -0,0 +1,167 @@
+"use strict";
+
+// The admin token is kept in localStorage so the page survives a reload.
+const tokenKey = "gomailify-token";
+const refreshMs = 10000;
+
+let timer;
+
+async function api(method, path, body) {
+  const resp = await fetch(path, {
+    method,
+    headers: {
+      "Authorization": "Bearer " + localStorage.getItem(tokenKey),
+      "Content-Type": "application/json",
+    },
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  const data = await resp.json().catch(() => ({}));
+  if (resp.status === 401) {
+    signOut("Invalid token.");
+    throw new Error("unauthorized");
+  }
+  if (!resp.ok) {
+    throw new Error(data.error || resp.statusText);
+  }
+  return data;
+}
+
+function when(t) {
+  if (!t || t.startsWith("0001-")) {
+    return "never";
+  }
+  const d = new Date(t);
+  const secs = Math.round((Date.now() - d) / 1000);
+  let ago;
+  if (secs < 60) ago = secs + "s ago";
+  else if (secs < 3600) ago = Math.round(secs / 60) + "m ago";
+  else if (secs < 86400) ago = Math.round(secs / 3600) + "h ago";
+  else ago = Math.round(secs / 86400) + "d ago";
+  return d.toLocaleString() + " (" + ago + ")";
+}
+
+function cell(row, text, cls) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+  return td;
+}
+
+function fill(el, acct, messages, failures) {
+  const st = acct.status;
+  const q = (sel) => el.querySelector(sel);
+
+  q(".name").textContent = acct.name;
+  q(".health").textContent = acct.healthy ? "ok" : "failing";
+  q(".health").className = "badge health " + (acct.healthy ? "ok" : "failing");
+  q(".paused").hidden = !acct.paused;
+  q(".dry").hidden = !acct.dry_run;
+  q(".protocol").textContent = acct.protocol.toUpperCase() + " · " + acct.host;
+  q(".mode").textContent = acct.mode === "idle" ? "IDLE (push)" : "polling";
+  q(".forward-to").textContent = acct.forward_to + " (" + acct.delivery + ")";
+  q(".last-sync").textContent = when(st.last_fetch);
+  q(".last-forward").textContent = when(st.last_forward);
+  q(".last-error").textContent = st.last_error ? st.last_error + " — " + when(st.last_error_at) : "none";
+  q(".pause").hidden = acct.paused;
+  q(".resume").hidden = !acct.paused;
+  q(".poll").disabled = acct.paused;
+
+  const name = encodeURIComponent(acct.name);
+  q(".poll").onclick = () => act("POST", "/api/accounts/" + name + "/poll");
+  q(".pause").onclick = () => act("POST", "/api/accounts/" + name + "/pause");
+  q(".resume").onclick = () => act("POST", "/api/accounts/" + name + "/resume");
+
+  const mbody = q(".messages tbody");
+  mbody.replaceChildren();
+  for (const m of messages) {
+    const row = mbody.insertRow();
+    cell(row, new Date(m.time).toLocaleString());
+    cell(row, m.from || "");
+    cell(row, m.subject || m.message_id || m.id);
+    if (m.error) cell(row, m.error, "error");
+    else cell(row, "forwarded");
+  }
+  if (messages.length === 0) {
+    cell(mbody.insertRow(), "Nothing forwarded since start.", "muted").colSpan = 4;
+  }
+
+  const fbody = q(".failures tbody");
+  fbody.replaceChildren();
+  for (const f of failures) {
+    const row = fbody.insertRow();
+    cell(row, new Date(f.updated_at).toLocaleString());
+    cell(row, f.id);
+    cell(row, (f.attempts || 0) + (f.state === "dead_lettered" ? " (gave up)" : ""));
+    cell(row, f.last_error || "", "error");
+    const btn = document.createElement("button");
+    btn.textContent = "Retry";
+    btn.onclick = () => act("POST", "/api/accounts/" + name + "/retry", { id: f.id });
+    row.insertCell().append(btn);
+  }
+  if (failures.length === 0) {
+    cell(fbody.insertRow(), "No failures.", "muted").colSpan = 5;
+  }
+}
+
+async function act(method, path, body) {
+  try {
+    await api(method, path, body);
+  } catch (e) {
+    if (e.message !== "unauthorized") alert(e.message);
+    return;
+  }
+  refresh();
+}
+
+async function refresh() {
+  clearTimeout(timer);
+  try {
+    const accounts = await api("GET", "/api/accounts");
+    const main = document.getElementById("accounts");
+    const tmpl = document.getElementById("account");
+    const sections = await Promise.all(accounts.map(async (acct) => {
+      const name = encodeURIComponent(acct.name);
+      const [messages, failures] = await Promise.all([
+        api("GET", "/api/accounts/" + name + "/messages"),
+        api("GET", "/api/accounts/" + name + "/failures"),
+      ]);
+      const el = tmpl.content.firstElementChild.cloneNode(true);
+      fill(el, acct, messages, failures);
+      return el;
+    }));
+    main.replaceChildren(...sections);
+    if (sections.length === 0) {
+      main.textContent = "No accounts are running.";
+    }
+    document.getElementById("updated").textContent = "updated " + new Date().toLocaleTimeString();
+  } catch (e) {
+    if (e.message === "unauthorized") return;
+    document.getElementById("updated").textContent = "update failed: " + e.message;
+  }
+  timer = setTimeout(refresh, refreshMs);
+}
+
+function signOut(message) {
+  clearTimeout(timer);
+  localStorage.removeItem(tokenKey);
+  document.getElementById("accounts").replaceChildren();
+  document.getElementById("logout").hidden = true;
+  document.getElementById("login").hidden = false;
+  document.getElementById("login-error").textContent = message || "";
+}
+
+function signIn() {
+  document.getElementById("login").hidden = true;
+  document.getElementById("logout").hidden = false;
+  refresh();
+}
+
+document.getElementById("login").onsubmit = (ev) => {
+  ev.preventDefault();
+  localStorage.setItem(tokenKey, document.getElementById("token").value);
+  signIn();
+};
+document.getElementById("logout").onclick = () => signOut();
+
+if (localStorage.getItem(tokenKey)) signIn();
+else signOut();
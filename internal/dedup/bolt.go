@@ -0,0 +1,178 @@
+package dedup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var seenBucket = []byte("seen")
+
+// boltStore keeps records in a bbolt database, keyed by message ID with the
+// JSON-encoded Record as value. Every write is a durable transaction.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBolt(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf("open dedup db %s: locked by another process", path)
+		}
+		return nil, fmt.Errorf("open dedup db: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(seenBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init dedup db: %w", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+// openBoltReadOnly opens an existing database without writing to it. It
+// shares the file lock with other readers but not with a writer.
+func openBoltReadOnly(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf("open dedup db %s: locked by another process", path)
+		}
+		return nil, fmt.Errorf("open dedup db: %w", err)
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(seenBucket) == nil {
+			return errors.New("no records bucket")
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open dedup db: %w", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(id string) (Record, bool, error) {
+	var (
+		rec   Record
+		found bool
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(seenBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &rec)
+	})
+	if err != nil {
+		return Record{}, false, fmt.Errorf("read dedup db: %w", err)
+	}
+	return rec.normalize(), found, nil
+}
+
+func (s *boltStore) Put(rec Record) error {
+	val, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode dedup record: %w", err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(seenBucket).Put([]byte(rec.ID), val)
+	})
+	if err != nil {
+		return fmt.Errorf("write dedup db: %w", err)
+	}
+	return nil
+}
+
+func (s *boltStore) Add(recs ...Record) (int, error) {
+	added := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(seenBucket)
+		for _, rec := range recs {
+			key := []byte(rec.ID)
+			if b.Get(key) != nil {
+				continue
+			}
+			val, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, val); err != nil {
+				return err
+			}
+			added++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("write dedup db: %w", err)
+	}
+	return added, nil
+}
+
+func (s *boltStore) ForEach(fn func(Record) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(seenBucket).ForEach(func(k, v []byte) error {
+			var rec Record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("decode record %q: %w", k, err)
+			}
+			return fn(rec.normalize())
+		})
+	})
+}
+
+func (s *boltStore) Prune(cutoff time.Time, keep func(id string) bool) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(seenBucket)
+		// Collect first: deleting under a cursor can make it skip keys.
+		var stale [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var rec Record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("decode record %q: %w", k, err)
+			}
+			if rec.FirstSeen.Before(cutoff) && (keep == nil || !keep(rec.ID)) {
+				stale = append(stale, bytes.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(stale)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("prune dedup db: %w", err)
+	}
+	return removed, nil
+}
+
+func (s *boltStore) Count() (int, error) {
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(seenBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -1,91 +1,362 @@
 package dedup
 
 import (
-	"bufio"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"time"
 )
 
-// Tracker keeps track of forwarded email IDs to prevent duplicates.
-// IDs are persisted to a file so they survive restarts.
+// Tracker keeps a delivery record for every email it has handled, to prevent
+// duplicates and to answer what happened to a given message. Records are
+// persisted in a Store so they survive restarts.
 type Tracker struct {
-	mu   sync.Mutex
-	ids  map[string]struct{}
-	file string
+	mu    sync.Mutex // serializes read-modify-write updates
+	store Store
 }
 
-// NewTracker loads (or creates) a dedup tracker backed by filePath.
-func NewTracker(filePath string) (*Tracker, error) {
-	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
-		return nil, fmt.Errorf("create dedup dir: %w", err)
+// Path returns the file that holds the state for base with the given backend.
+func Path(base, backend string) string {
+	if backend == BackendFile {
+		return base + ".seen"
 	}
+	return base + ".db"
+}
+
+// Exists reports whether any dedup state, in either backend, exists for base.
+func Exists(base string) bool {
+	_, ok := Detect(base)
+	return ok
+}
 
-	t := &Tracker{
-		ids:  make(map[string]struct{}),
-		file: filePath,
+// Detect returns the backend holding state for base, preferring bolt when
+// both exist, and whether any was found.
+func Detect(base string) (string, bool) {
+	for _, backend := range []string{BackendBolt, BackendFile} {
+		if _, err := os.Stat(Path(base, backend)); err == nil {
+			return backend, true
+		}
 	}
+	return "", false
+}
 
-	f, err := os.Open(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return t, nil
+// Options tunes how a Tracker persists its state.
+type Options struct {
+	// GroupCommit lets concurrent writes to the file backend share one
+	// fsync issued after this window. Zero fsyncs every write.
+	GroupCommit time.Duration
+
+	// Logger receives notices about repairs and migrations. Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+}
+
+// Open loads (or creates) the tracker stored at base using backend. When
+// opening an empty bolt store next to a legacy .seen file, the file's IDs are
+// imported and the file is renamed to .seen.migrated.
+func Open(base, backend string, opts Options) (*Tracker, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if err := os.MkdirAll(filepath.Dir(base), 0o755); err != nil {
+		return nil, fmt.Errorf("create dedup dir: %w", err)
+	}
+
+	switch backend {
+	case BackendFile:
+		fs, err := openFile(Path(base, BackendFile), opts.GroupCommit, opts.Logger)
+		if err != nil {
+			return nil, err
+		}
+		return &Tracker{store: fs}, nil
+
+	case BackendBolt, "":
+		bs, err := openBolt(Path(base, BackendBolt))
+		if err != nil {
+			return nil, err
+		}
+		if err := migrateLegacy(bs, Path(base, BackendFile), opts.Logger); err != nil {
+			bs.Close()
+			return nil, err
 		}
-		return nil, fmt.Errorf("open dedup file: %w", err)
+		return &Tracker{store: bs}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown dedup backend %q", backend)
 	}
-	defer f.Close()
+}
+
+// OpenReadOnly opens the existing tracker stored at base using backend for
+// reading only. Unlike Open, it never migrates, repairs or compacts the
+// state, and every write fails.
+func OpenReadOnly(base, backend string, opts Options) (*Tracker, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	switch backend {
+	case BackendFile:
+		fs, err := openFileReadOnly(Path(base, BackendFile), opts.Logger)
+		if err != nil {
+			return nil, err
+		}
+		return &Tracker{store: fs}, nil
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" {
-			t.ids[line] = struct{}{}
+	case BackendBolt, "":
+		bs, err := openBoltReadOnly(Path(base, BackendBolt))
+		if err != nil {
+			return nil, err
 		}
+		return &Tracker{store: bs}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown dedup backend %q", backend)
+	}
+}
+
+// migrateLegacy imports a .seen file into an empty bolt store.
+func migrateLegacy(bs *boltStore, legacyPath string, logger *slog.Logger) error {
+	if _, err := os.Stat(legacyPath); err != nil {
+		return nil
+	}
+	if n, err := bs.Count(); err != nil || n > 0 {
+		return err
+	}
+
+	fs, err := openFile(legacyPath, 0, logger)
+	if err != nil {
+		return err
+	}
+	recs := make([]Record, 0, len(fs.recs))
+	for _, rec := range fs.recs {
+		recs = append(recs, rec)
+	}
+	fs.Close()
+	if _, err := bs.Add(recs...); err != nil {
+		return fmt.Errorf("migrate %s: %w", legacyPath, err)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("read dedup file: %w", err)
+	if err := os.Rename(legacyPath, legacyPath+".migrated"); err != nil {
+		return fmt.Errorf("migrate %s: %w", legacyPath, err)
 	}
+	logger.Info("migrated dedup file to bolt", "file", legacyPath, "records", len(recs))
+	return nil
+}
+
+// Seen reports whether id has reached a final state (forwarded,
+// dead-lettered or filtered) and must not be forwarded again.
+func (t *Tracker) Seen(id string) (bool, error) {
+	rec, ok, err := t.store.Get(id)
+	if err != nil || !ok {
+		return false, err
+	}
+	return rec.State.Done(), nil
+}
+
+// Lookup returns the delivery record for id and whether one exists.
+func (t *Tracker) Lookup(id string) (Record, bool, error) {
+	return t.store.Get(id)
+}
+
+// Discovered records that id was fetched and is about to be handled, unless
+// a record already exists.
+func (t *Tracker) Discovered(id, destination string) error {
+	_, err := t.store.Add(Record{
+		ID:          id,
+		State:       StateDiscovered,
+		Destination: destination,
+		FirstSeen:   time.Now(),
+		UpdatedAt:   time.Now(),
+	})
+	return err
+}
+
+// Forwarding records the start of a delivery attempt to destination.
+func (t *Tracker) Forwarding(id, destination string) error {
+	return t.update(id, func(rec *Record) {
+		rec.State = StateForwarding
+		rec.Attempts++
+		rec.Destination = destination
+	})
+}
+
+// Forwarded records a successful delivery.
+func (t *Tracker) Forwarded(id string) error {
+	return t.update(id, func(rec *Record) {
+		rec.State = StateForwarded
+		rec.LastError = ""
+	})
+}
 
-	return t, nil
+// Failed records a failed delivery attempt. Once the record has used up
+// maxAttempts attempts it is dead-lettered instead; maxAttempts <= 0 retries
+// forever. It returns the resulting state.
+func (t *Tracker) Failed(id string, cause error, maxAttempts int) (State, error) {
+	var state State
+	err := t.update(id, func(rec *Record) {
+		rec.State = StateFailed
+		if maxAttempts > 0 && rec.Attempts >= maxAttempts {
+			rec.State = StateDeadLettered
+		}
+		rec.LastError = cause.Error()
+		state = rec.State
+	})
+	return state, err
 }
 
-// SeenIDs returns a snapshot of all tracked IDs.
-func (t *Tracker) SeenIDs() map[string]struct{} {
+// Retry makes a failed or dead-lettered message eligible for delivery again,
+// with a fresh count of attempts, so the next fetch forwards it. It reports
+// false if id has no record in either state.
+func (t *Tracker) Retry(id string) (bool, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	cp := make(map[string]struct{}, len(t.ids))
-	for k := range t.ids {
-		cp[k] = struct{}{}
+
+	rec, ok, err := t.store.Get(id)
+	if err != nil || !ok {
+		return false, err
+	}
+	if rec.State != StateFailed && rec.State != StateDeadLettered {
+		return false, nil
 	}
-	return cp
+	rec.State = StateFailed
+	rec.Attempts = 0
+	rec.UpdatedAt = time.Now()
+	return true, t.store.Put(rec)
 }
 
-// MarkSeen adds an ID and persists it to disk.
+// Filtered records that id was deliberately not forwarded, with the reason.
+func (t *Tracker) Filtered(id, reason string) error {
+	return t.update(id, func(rec *Record) {
+		rec.State = StateFiltered
+		rec.Note = reason
+	})
+}
+
+// MarkSeen records id as forwarded.
 func (t *Tracker) MarkSeen(id string) error {
+	return t.Forwarded(id)
+}
+
+// MarkSeenBatch records ids as filtered with the given reason in a single
+// write, leaving existing records untouched. It returns the number of IDs
+// that were not already tracked.
+func (t *Tracker) MarkSeenBatch(ids []string, reason string) (int, error) {
+	now := time.Now()
+	recs := make([]Record, 0, len(ids))
+	for _, id := range ids {
+		recs = append(recs, Record{
+			ID:        id,
+			State:     StateFiltered,
+			Note:      reason,
+			FirstSeen: now,
+			UpdatedAt: now,
+		})
+	}
+	return t.store.Add(recs...)
+}
+
+// ForEach calls fn for every record, in no particular order, stopping at the
+// first error.
+func (t *Tracker) ForEach(fn func(Record) error) error {
+	return t.store.ForEach(fn)
+}
+
+// Import merges recs into the tracker. A record for an ID that is already
+// tracked is combined with the existing one as described at Merge. It returns
+// the number of IDs that were not already tracked.
+func (t *Tracker) Import(recs []Record) (int, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	if _, exists := t.ids[id]; exists {
-		return nil
+
+	byID := make(map[string]Record, len(recs))
+	for _, rec := range recs {
+		if prev, ok := byID[rec.ID]; ok {
+			rec = Merge(prev, rec)
+		}
+		byID[rec.ID] = rec
 	}
-	t.ids[id] = struct{}{}
 
-	f, err := os.OpenFile(t.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
-	if err != nil {
-		return fmt.Errorf("open dedup file for append: %w", err)
+	var fresh []Record
+	for _, rec := range byID {
+		cur, ok, err := t.store.Get(rec.ID)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			fresh = append(fresh, rec)
+			continue
+		}
+		if merged := Merge(cur, rec); merged != cur {
+			if err := t.store.Put(merged); err != nil {
+				return 0, err
+			}
+		}
 	}
-	defer f.Close()
+	return t.store.Add(fresh...)
+}
 
-	if _, err := fmt.Fprintln(f, id); err != nil {
-		return fmt.Errorf("write dedup id: %w", err)
+// Recover marks deliveries that were in flight when the process last stopped
+// as failed, so they are retried. Whether the relay accepted them before the
+// crash is unknown; retrying errs on the side of a duplicate over a loss.
+// It returns the number of records recovered.
+func (t *Tracker) Recover() (int, error) {
+	var stuck []string
+	err := t.store.ForEach(func(rec Record) error {
+		if rec.State == StateForwarding {
+			stuck = append(stuck, rec.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	for _, id := range stuck {
+		err := t.update(id, func(rec *Record) {
+			rec.State = StateFailed
+			rec.LastError = "interrupted during delivery"
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(stuck), nil
 }
 
-// Count returns the number of tracked IDs.
-func (t *Tracker) Count() int {
+// update applies fn to the record for id, creating it if needed, and
+// persists the result.
+func (t *Tracker) update(id string, fn func(rec *Record)) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	return len(t.ids)
+
+	rec, ok, err := t.store.Get(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if !ok {
+		rec = Record{ID: id, FirstSeen: now}
+	}
+	fn(&rec)
+	rec.UpdatedAt = now
+	return t.store.Put(rec)
+}
+
+// Prune forgets IDs first seen more than maxAge ago, except those for which
+// keep (if not nil) returns true, and returns how many were removed.
+func (t *Tracker) Prune(maxAge time.Duration, keep func(id string) bool) (int, error) {
+	return t.store.Prune(time.Now().Add(-maxAge), keep)
+}
+
+// Count returns the number of tracked IDs, or -1 if the store cannot be read.
+func (t *Tracker) Count() int {
+	n, err := t.store.Count()
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// Close releases the underlying store.
+func (t *Tracker) Close() error {
+	return t.store.Close()
 }
@@ -0,0 +1,488 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileHeader opens every file written in the current format. Each following
+// line is "<crc32 hex>\t<JSON Record>\n"; a later line for the same ID
+// replaces the earlier one, which is how state changes are recorded.
+const fileHeader = "# gomailify dedup v2\n"
+
+// minCompactDead is the number of superseded lines below which compaction is
+// never worth the rewrite.
+const minCompactDead = 1000
+
+// fileStore keeps all records in memory and persists them to an append-only
+// text file. Every write is fsynced before Add returns; with a group-commit
+// window, concurrent writers share one fsync. On load, a torn final line left
+// by a crash is truncated away and corrupt lines are dropped. The file is
+// compacted by writing a fresh copy and renaming it over the original.
+//
+// Files in the original format (one bare ID per line, or "<id>\t<unix>") are
+// read and converted on open.
+type fileStore struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	recs   map[string]Record
+	dead   int // lines in the file no longer backing a live record
+	logger *slog.Logger
+
+	readOnly bool // opened by openFileReadOnly; every write fails
+
+	window  time.Duration // group-commit window; zero syncs every write
+	batchMu sync.Mutex
+	batch   *syncBatch
+}
+
+// syncBatch is a group of writers waiting on the same fsync.
+type syncBatch struct {
+	done chan struct{}
+	err  error
+}
+
+func openFile(path string, window time.Duration, logger *slog.Logger) (*fileStore, error) {
+	s := &fileStore{
+		path:   path,
+		recs:   make(map[string]Record),
+		logger: logger,
+		window: window,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read dedup file: %w", err)
+	}
+
+	rewrite := false
+	switch {
+	case len(data) == 0 || strings.HasPrefix(fileHeader, string(data)):
+		// New file, or a crash while writing the header.
+		rewrite = true
+	case bytes.HasPrefix(data, []byte(fileHeader)):
+		if rewrite, err = s.load(data); err != nil {
+			return nil, err
+		}
+	default:
+		s.loadLegacy(data)
+		logger.Info("converting dedup file to current format", "file", path, "records", len(s.recs))
+		rewrite = true
+	}
+
+	if rewrite {
+		if err := s.compactLocked(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	if s.f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+		return nil, fmt.Errorf("open dedup file for append: %w", err)
+	}
+	return s, nil
+}
+
+// errReadOnly is returned by writes to a store opened for reading only.
+var errReadOnly = errors.New("dedup file opened read-only")
+
+// openFileReadOnly loads the file at path without writing to it: a torn
+// final line or corrupt lines are skipped rather than repaired, and legacy
+// files are read but not converted.
+func openFileReadOnly(path string, logger *slog.Logger) (*fileStore, error) {
+	s := &fileStore{
+		path:     path,
+		recs:     make(map[string]Record),
+		logger:   logger,
+		readOnly: true,
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read dedup file: %w", err)
+	}
+	switch {
+	case len(data) == 0 || strings.HasPrefix(fileHeader, string(data)):
+	case bytes.HasPrefix(data, []byte(fileHeader)):
+		if _, err := s.load(data); err != nil {
+			return nil, err
+		}
+	default:
+		s.loadLegacy(data)
+	}
+	return s, nil
+}
+
+// load parses a current-format file. A torn or corrupt final line is
+// truncated away in place; corrupt lines elsewhere are skipped and reported
+// via the returned flag so the caller can rewrite the file without them.
+func (s *fileStore) load(data []byte) (bool, error) {
+	off := len(fileHeader)
+	corrupt := 0
+	for off < len(data) {
+		nl := bytes.IndexByte(data[off:], '\n')
+		if nl < 0 {
+			return false, s.truncateTail(off, len(data)-off)
+		}
+
+		rec, ok := decodeLine(data[off : off+nl])
+		end := off + nl + 1
+		if !ok {
+			if end == len(data) {
+				return false, s.truncateTail(off, nl+1)
+			}
+			corrupt++
+			off = end
+			continue
+		}
+		if _, exists := s.recs[rec.ID]; exists {
+			s.dead++
+		}
+		s.recs[rec.ID] = rec
+		off = end
+	}
+
+	if corrupt > 0 {
+		s.logger.Warn("dropped corrupt dedup records", "file", s.path, "count", corrupt)
+	}
+	return corrupt > 0, nil
+}
+
+// truncateTail cuts the file back to off, discarding a partial final record.
+// A read-only store only ignores it.
+func (s *fileStore) truncateTail(off, n int) error {
+	if s.readOnly {
+		return nil
+	}
+	s.logger.Warn("repairing truncated dedup file", "file", s.path, "discarded_bytes", n)
+	f, err := os.OpenFile(s.path, os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("repair dedup file: %w", err)
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(off)); err != nil {
+		return fmt.Errorf("repair dedup file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("repair dedup file: %w", err)
+	}
+	return nil
+}
+
+// loadLegacy parses the original format. IDs without a timestamp are treated
+// as first seen now.
+func (s *fileStore) loadLegacy(data []byte) {
+	loaded := time.Now()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		id, ts, ok := strings.Cut(line, "\t")
+		rec := Record{ID: id, FirstSeen: loaded}
+		if ok {
+			if n, err := strconv.ParseInt(ts, 10, 64); err == nil {
+				rec.FirstSeen = time.Unix(n, 0)
+			}
+		}
+		s.recs[id] = rec
+	}
+}
+
+func (s *fileStore) Get(id string) (Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.recs[id]
+	return rec.normalize(), ok, nil
+}
+
+// Put appends rec, superseding any earlier line for the same ID.
+func (s *fileStore) Put(rec Record) error {
+	line, err := encodeLine(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if err := s.appendLocked(line); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if _, exists := s.recs[rec.ID]; exists {
+		s.dead++
+	}
+	s.recs[rec.ID] = rec
+	compacted, err := s.maybeCompactLocked()
+	s.mu.Unlock()
+	if err != nil || compacted {
+		return err
+	}
+
+	if err := s.sync(); err != nil {
+		return fmt.Errorf("sync dedup file: %w", err)
+	}
+	return nil
+}
+
+func (s *fileStore) ForEach(fn func(Record) error) error {
+	s.mu.Lock()
+	recs := make([]Record, 0, len(s.recs))
+	for _, rec := range s.recs {
+		recs = append(recs, rec.normalize())
+	}
+	s.mu.Unlock()
+
+	for _, rec := range recs {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) Add(recs ...Record) (int, error) {
+	s.mu.Lock()
+	var buf bytes.Buffer
+	fresh := make(map[string]Record)
+	for _, rec := range recs {
+		if _, exists := s.recs[rec.ID]; exists {
+			continue
+		}
+		if _, exists := fresh[rec.ID]; exists {
+			continue
+		}
+		line, err := encodeLine(rec)
+		if err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+		buf.Write(line)
+		fresh[rec.ID] = rec
+	}
+	if len(fresh) == 0 {
+		s.mu.Unlock()
+		return 0, nil
+	}
+	if err := s.appendLocked(buf.Bytes()); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	maps.Copy(s.recs, fresh)
+	added := len(fresh)
+	compacted, err := s.maybeCompactLocked()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if compacted {
+		return added, nil
+	}
+
+	if err := s.sync(); err != nil {
+		return 0, fmt.Errorf("sync dedup file: %w", err)
+	}
+	return added, nil
+}
+
+// appendLocked writes lines to the end of the file. If the write fails, the
+// file is rewritten from the records in memory, so that a partial line does
+// not remain to corrupt the next one. s.mu must be held.
+func (s *fileStore) appendLocked(lines []byte) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	if _, err := s.f.Write(lines); err != nil {
+		if cerr := s.compactLocked(); cerr != nil {
+			s.logger.Error("repair dedup file after failed write", "file", s.path, "error", cerr)
+		}
+		return fmt.Errorf("write dedup record: %w", err)
+	}
+	return nil
+}
+
+// maybeCompactLocked compacts the file once superseded lines outnumber live
+// records. It reports whether it did, in which case everything written so
+// far is already durable. s.mu must be held.
+func (s *fileStore) maybeCompactLocked() (bool, error) {
+	if s.dead < max(minCompactDead, len(s.recs)) {
+		return false, nil
+	}
+	return true, s.compactLocked()
+}
+
+// sync makes all writes so far durable. With a group-commit window, callers
+// arriving within the window share a single fsync.
+func (s *fileStore) sync() error {
+	if s.window <= 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.f.Sync()
+	}
+
+	s.batchMu.Lock()
+	b := s.batch
+	if b == nil {
+		b = &syncBatch{done: make(chan struct{})}
+		s.batch = b
+		time.AfterFunc(s.window, func() { s.flush(b) })
+	}
+	s.batchMu.Unlock()
+
+	<-b.done
+	return b.err
+}
+
+// flush closes batch b to new writers and fsyncs on its behalf.
+func (s *fileStore) flush(b *syncBatch) {
+	s.batchMu.Lock()
+	s.batch = nil
+	s.batchMu.Unlock()
+
+	s.mu.Lock()
+	b.err = s.f.Sync()
+	s.mu.Unlock()
+	close(b.done)
+}
+
+// Prune drops old records and compacts the file without them.
+func (s *fileStore) Prune(cutoff time.Time, keep func(id string) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for id, rec := range s.recs {
+		if rec.FirstSeen.Before(cutoff) && (keep == nil || !keep(id)) {
+			delete(s.recs, id)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := s.compactLocked(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// compactLocked atomically replaces the file with one holding only the live
+// records: it writes and fsyncs a temporary file, renames it over the
+// original, and fsyncs the directory. s.mu must be held.
+func (s *fileStore) compactLocked() error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("compact dedup file: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	w.WriteString(fileHeader)
+	for _, rec := range s.recs {
+		line, err := encodeLine(rec)
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+		w.Write(line)
+	}
+	if err := w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compact dedup file: %w", err)
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compact dedup file: %w", err)
+	}
+	if err := syncDir(filepath.Dir(s.path)); err != nil {
+		return fmt.Errorf("compact dedup file: %w", err)
+	}
+
+	if s.f != nil {
+		s.f.Close()
+	}
+	if s.f, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+		return fmt.Errorf("open dedup file for append: %w", err)
+	}
+	s.dead = 0
+	return nil
+}
+
+func (s *fileStore) Count() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.recs), nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	return err
+}
+
+// encodeLine returns rec as a checksummed record line.
+func encodeLine(rec Record) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("encode dedup record: %w", err)
+	}
+	return fmt.Appendf(nil, "%08x\t%s\n", crc32.ChecksumIEEE(payload), payload), nil
+}
+
+// decodeLine parses a record line (without its newline), verifying the checksum.
+func decodeLine(line []byte) (Record, bool) {
+	var rec Record
+	sum, payload, ok := bytes.Cut(line, []byte("\t"))
+	if !ok {
+		return rec, false
+	}
+	want, err := strconv.ParseUint(string(sum), 16, 32)
+	if err != nil || uint32(want) != crc32.ChecksumIEEE(payload) {
+		return rec, false
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil || rec.ID == "" {
+		return rec, false
+	}
+	return rec, true
+}
+
+// syncDir fsyncs a directory so a rename within it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
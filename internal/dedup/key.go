@@ -0,0 +1,33 @@
+package dedup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyPath returns the file that records which dedup key the IDs stored for
+// base were derived with.
+func KeyPath(base string) string {
+	return base + ".key"
+}
+
+// StoredKey returns the dedup key recorded for base, or "" if none is.
+func StoredKey(base string) (string, error) {
+	data, err := os.ReadFile(KeyPath(base))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read dedup key: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// RecordKey records key as the dedup key of the IDs stored for base.
+func RecordKey(base, key string) error {
+	if err := os.WriteFile(KeyPath(base), []byte(key+"\n"), 0o644); err != nil {
+		return fmt.Errorf("record dedup key: %w", err)
+	}
+	return nil
+}
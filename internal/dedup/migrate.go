@@ -0,0 +1,94 @@
+package dedup
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Merge combines two records for the same message. A final state wins over
+// one that is not, since it means the message was dealt with by one of them;
+// otherwise the more recently updated record wins. The earliest FirstSeen is
+// kept so retention counts from the first sighting.
+func Merge(a, b Record) Record {
+	a, b = a.normalize(), b.normalize()
+	winner, other := a, b
+	switch {
+	case a.State.Done() != b.State.Done():
+		if b.State.Done() {
+			winner, other = b, a
+		}
+	case b.UpdatedAt.After(a.UpdatedAt):
+		winner, other = b, a
+	}
+	if !other.FirstSeen.IsZero() && other.FirstSeen.Before(winner.FirstSeen) {
+		winner.FirstSeen = other.FirstSeen
+	}
+	return winner
+}
+
+// Migrate moves the state for base into backend to, copying every record from
+// the other backend and renaming the source file to <file>.migrated. It fails
+// if base already has state in the target backend. It returns the number of
+// records copied.
+func Migrate(base, to string, opts Options) (int, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	var from string
+	switch to {
+	case BackendBolt:
+		from = BackendFile
+	case BackendFile:
+		from = BackendBolt
+	default:
+		return 0, fmt.Errorf("unknown dedup backend %q", to)
+	}
+	src, dst := Path(base, from), Path(base, to)
+	if _, err := os.Stat(src); err != nil {
+		return 0, fmt.Errorf("no %s state at %s", from, src)
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return 0, fmt.Errorf("%s already exists", dst)
+	}
+
+	in, err := openStore(src, from, opts)
+	if err != nil {
+		return 0, err
+	}
+	var recs []Record
+	err = in.ForEach(func(rec Record) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	in.Close()
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %w", src, err)
+	}
+
+	out, err := openStore(dst, to, opts)
+	if err != nil {
+		return 0, err
+	}
+	n, err := out.Add(recs...)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return 0, fmt.Errorf("write %s: %w", dst, err)
+	}
+	if err := os.Rename(src, src+".migrated"); err != nil {
+		return n, fmt.Errorf("migrate %s: %w", src, err)
+	}
+	return n, nil
+}
+
+// openStore opens the store file at path with backend, without the legacy
+// import Open performs.
+func openStore(path, backend string, opts Options) (Store, error) {
+	if backend == BackendFile {
+		return openFile(path, opts.GroupCommit, opts.Logger)
+	}
+	return openBolt(path)
+}
@@ -0,0 +1,239 @@
+package dedup
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClaimResult is the outcome of Shared.Claim.
+type ClaimResult int
+
+const (
+	// ClaimGranted means the caller now owns delivery of the message to
+	// the destination and should forward it.
+	ClaimGranted ClaimResult = iota
+
+	// ClaimDuplicate means another account already delivered the message
+	// to the destination; the caller's copy must not be forwarded.
+	ClaimDuplicate
+
+	// ClaimPending means another account holds a claim on the message but
+	// has not delivered it yet. The caller should leave its copy for a
+	// later fetch, by which time the claim is either settled or released.
+	ClaimPending
+)
+
+// Shared deduplicates messages across accounts. It tracks one record per
+// (destination, Message-ID) pair, naming the account that claimed delivery in
+// the record's Note, so when several accounts receive the same message only
+// the first to claim it forwards it. It is safe for concurrent use by all
+// forwarders in the process.
+type Shared struct {
+	mu    sync.Mutex // serializes claim checks with their writes
+	store Store
+}
+
+// SharedPath returns the file that holds the shared state in dataDir. The
+// leading dot keeps it apart from per-account files, whose sanitized names
+// never contain one.
+func SharedPath(dataDir, backend string) string {
+	return Path(filepath.Join(dataDir, ".shared"), backend)
+}
+
+// DetectShared returns the backend holding shared state in dataDir and
+// whether any was found.
+func DetectShared(dataDir string) (string, bool) {
+	return Detect(filepath.Join(dataDir, ".shared"))
+}
+
+// OpenShared loads (or creates) the shared store in dataDir using backend.
+func OpenShared(dataDir, backend string, opts Options) (*Shared, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create dedup dir: %w", err)
+	}
+
+	switch backend {
+	case BackendFile, BackendBolt:
+	case "":
+		backend = BackendBolt
+	default:
+		return nil, fmt.Errorf("unknown dedup backend %q", backend)
+	}
+	store, err := openStore(SharedPath(dataDir, backend), backend, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Shared{store: store}, nil
+}
+
+// sharedKey returns the store key for messageID sent to destination.
+// Addresses compare case-insensitively. Angle brackets are stripped from the
+// Message-ID because IMAP envelopes omit them while raw headers keep them.
+func sharedKey(destination, messageID string) string {
+	id := strings.TrimSpace(messageID)
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	return strings.ToLower(strings.TrimSpace(destination)) + "\x00" + id
+}
+
+// Claim asks to deliver messageID to destination on behalf of account. An
+// account may always re-claim its own messages, and anyone may claim one
+// whose previous owner released it.
+func (s *Shared) Claim(destination, messageID, account string) (ClaimResult, string, error) {
+	key := sharedKey(destination, messageID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	rec, ok, err := s.store.Get(key)
+	if err != nil {
+		return ClaimPending, "", err
+	}
+	if ok && rec.Note != account && rec.State != StateFailed {
+		if rec.State == StateForwarded {
+			return ClaimDuplicate, rec.Note, nil
+		}
+		return ClaimPending, rec.Note, nil
+	}
+	if !ok {
+		rec = Record{ID: key, FirstSeen: now}
+	}
+	rec.State = StateForwarding
+	rec.Note = account
+	rec.Destination = destination
+	rec.UpdatedAt = now
+	if err := s.store.Put(rec); err != nil {
+		return ClaimPending, "", err
+	}
+	return ClaimGranted, account, nil
+}
+
+// Delivered records that the claimed message reached destination.
+func (s *Shared) Delivered(destination, messageID string) error {
+	return s.settle(destination, messageID, StateForwarded)
+}
+
+// Release gives up a claim after a failed delivery so that any account's copy
+// may be forwarded instead.
+func (s *Shared) Release(destination, messageID string) error {
+	return s.settle(destination, messageID, StateFailed)
+}
+
+func (s *Shared) settle(destination, messageID string, state State) error {
+	key := sharedKey(destination, messageID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok, err := s.store.Get(key)
+	if err != nil || !ok {
+		return err
+	}
+	rec.State = state
+	rec.UpdatedAt = time.Now()
+	return s.store.Put(rec)
+}
+
+// ReleaseOwner releases every claim account holds on a message it has not
+// delivered yet, except those on the Message-IDs in keep sent to destination,
+// which the account still holds in a spool. Claims are left in flight when an
+// account stops abruptly or is removed; without this, other accounts would
+// defer their copies forever. It returns the number of claims released.
+func (s *Shared) ReleaseOwner(account, destination string, keep []string) (int, error) {
+	kept := make(map[string]bool, len(keep))
+	for _, id := range keep {
+		kept[sharedKey(destination, id)] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stale []Record
+	err := s.store.ForEach(func(rec Record) error {
+		if rec.Note == account && rec.State == StateForwarding && !kept[rec.ID] {
+			stale = append(stale, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	for _, rec := range stale {
+		rec.State = StateFailed
+		rec.UpdatedAt = now
+		if err := s.store.Put(rec); err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}
+
+// Owners returns the accounts that hold claims on messages they have not
+// delivered yet.
+func (s *Shared) Owners() ([]string, error) {
+	var owners []string
+	err := s.store.ForEach(func(rec Record) error {
+		if rec.State == StateForwarding && !slices.Contains(owners, rec.Note) {
+			owners = append(owners, rec.Note)
+		}
+		return nil
+	})
+	return owners, err
+}
+
+// RenameOwner transfers every claim held by account from to account to, so
+// that a renamed account keeps the claims it made under its old name. It
+// returns the number of claims transferred.
+func (s *Shared) RenameOwner(from, to string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var owned []Record
+	err := s.store.ForEach(func(rec Record) error {
+		if rec.Note == from {
+			owned = append(owned, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range owned {
+		rec.Note = to
+		if err := s.store.Put(rec); err != nil {
+			return 0, err
+		}
+	}
+	return len(owned), nil
+}
+
+// Prune forgets claims first made more than maxAge ago and returns how many
+// were removed.
+func (s *Shared) Prune(maxAge time.Duration) (int, error) {
+	return s.store.Prune(time.Now().Add(-maxAge), nil)
+}
+
+// Count returns the number of tracked messages, or -1 if the store cannot be
+// read.
+func (s *Shared) Count() int {
+	n, err := s.store.Count()
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// Close releases the underlying store.
+func (s *Shared) Close() error {
+	return s.store.Close()
+}
@@ -0,0 +1,84 @@
+package dedup
+
+import "time"
+
+// Storage backends accepted by Open.
+const (
+	BackendBolt = "bolt" // embedded bbolt database, one file per account
+	BackendFile = "file" // append-only text file
+)
+
+// State is the delivery state of one message.
+type State string
+
+// Delivery states. A message normally moves discovered → forwarding →
+// forwarded. A failed send moves it to failed, from where the next fetch
+// retries it; after too many attempts it is dead-lettered and left alone.
+// Filtered messages were deliberately not forwarded.
+const (
+	StateDiscovered   State = "discovered"
+	StateForwarding   State = "forwarding"
+	StateForwarded    State = "forwarded"
+	StateFailed       State = "failed"
+	StateDeadLettered State = "dead_lettered"
+	StateFiltered     State = "filtered"
+)
+
+// Done reports whether s is final, meaning the message must not be fetched
+// and forwarded again.
+func (s State) Done() bool {
+	return s == StateForwarded || s == StateDeadLettered || s == StateFiltered
+}
+
+// Record is the persisted delivery state of one message.
+type Record struct {
+	ID          string    `json:"id"`
+	State       State     `json:"state,omitempty"`
+	Attempts    int       `json:"attempts,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Note        string    `json:"note,omitempty"` // free-form detail, e.g. why a message was filtered
+	Destination string    `json:"destination,omitempty"`
+	FirstSeen   time.Time `json:"first_seen"`
+	UpdatedAt   time.Time `json:"updated_at,omitzero"`
+}
+
+// normalize fills in defaults for records written before states existed,
+// which only ever recorded forwarded messages.
+func (r Record) normalize() Record {
+	if r.State == "" {
+		r.State = StateForwarded
+	}
+	if r.UpdatedAt.IsZero() {
+		r.UpdatedAt = r.FirstSeen
+	}
+	return r
+}
+
+// Store persists dedup records. Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the record for id and whether it exists.
+	Get(id string) (Record, bool, error)
+
+	// Put creates or replaces the record for rec.ID.
+	Put(rec Record) error
+
+	// Add stores the given records, skipping IDs that already exist, and
+	// returns how many were new. All records are written atomically where
+	// the backend supports it.
+	Add(recs ...Record) (int, error)
+
+	// ForEach calls fn for every record, in no particular order, stopping
+	// at the first error.
+	ForEach(fn func(Record) error) error
+
+	// Prune deletes records first seen before cutoff, except those for
+	// which keep (if not nil) returns true, and returns how many were
+	// removed.
+	Prune(cutoff time.Time, keep func(id string) bool) (int, error)
+
+	// Count returns the number of stored records.
+	Count() (int, error)
+
+	// Close releases the underlying file or database.
+	Close() error
+}
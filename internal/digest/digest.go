@@ -0,0 +1,142 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/textproto"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+)
+
+var tocTemplate = template.Must(template.New("toc").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>{{len .Entries}} new message(s) for <b>{{.Account}}</b>, collected by gomailify.
+Each message is attached in full below.</p>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>#</th><th>Date</th><th>From</th><th>Subject</th></tr>
+{{range $i, $e := .Entries}}<tr><td>{{inc $i}}</td><td>{{$e.Date}}</td><td>{{$e.From}}</td><td>{{$e.Subject}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type tocEntry struct {
+	Date    string
+	From    string
+	Subject string
+}
+
+// Build composes a single digest message addressed from→to that bundles
+// emails. The result is a multipart/mixed message whose first part is an HTML
+// table of contents and whose second part is a multipart/digest holding each
+// original email as a message/rfc822 part.
+func Build(account, from, to string, emails []receiver.Email, now time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	outer := multipart.NewWriter(&body)
+
+	entries := make([]tocEntry, 0, len(emails))
+	for _, e := range emails {
+		entries = append(entries, summarize(e))
+	}
+
+	tocPart, err := outer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("digest toc part: %w", err)
+	}
+	if err := tocTemplate.Execute(tocPart, struct {
+		Account string
+		Entries []tocEntry
+	}{account, entries}); err != nil {
+		return nil, fmt.Errorf("digest toc: %w", err)
+	}
+
+	var inner bytes.Buffer
+	digestWriter := multipart.NewWriter(&inner)
+	for _, e := range emails {
+		part, err := digestWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"message/rfc822"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("digest message part: %w", err)
+		}
+		if _, err := part.Write(e.Content); err != nil {
+			return nil, fmt.Errorf("digest message part: %w", err)
+		}
+	}
+	if err := digestWriter.Close(); err != nil {
+		return nil, fmt.Errorf("digest close: %w", err)
+	}
+
+	digestPart, err := outer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("multipart/digest", map[string]string{"boundary": digestWriter.Boundary()})},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("digest part: %w", err)
+	}
+	if _, err := digestPart.Write(inner.Bytes()); err != nil {
+		return nil, fmt.Errorf("digest part: %w", err)
+	}
+	if err := outer.Close(); err != nil {
+		return nil, fmt.Errorf("digest close: %w", err)
+	}
+
+	var msg bytes.Buffer
+	subject := fmt.Sprintf("Digest for %s: %d message(s)", account, len(emails))
+	fmt.Fprintf(&msg, "From: %s\r\n", (&netmail.Address{Name: "gomailify", Address: from}).String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <digest-%s@gomailify>\r\n", randomID())
+	fmt.Fprintf(&msg, "X-Forwarded-By: gomailify\r\n")
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: %s\r\n\r\n",
+		mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": outer.Boundary()}))
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// summarize extracts the table-of-contents fields from a raw email.
+func summarize(e receiver.Email) tocEntry {
+	entry := tocEntry{Subject: "(no subject)", From: "(unknown sender)"}
+	if !e.Date.IsZero() {
+		entry.Date = e.Date.Format("2006-01-02 15:04")
+	}
+
+	mr, err := mail.CreateReader(bytes.NewReader(e.Content))
+	if err != nil {
+		return entry
+	}
+	defer mr.Close()
+
+	if subject, err := mr.Header.Subject(); err == nil && subject != "" {
+		entry.Subject = subject
+	}
+	if addrs, err := mr.Header.AddressList("From"); err == nil && len(addrs) > 0 {
+		entry.From = addrs[0].Address
+		if addrs[0].Name != "" {
+			entry.From = fmt.Sprintf("%s <%s>", addrs[0].Name, addrs[0].Address)
+		}
+	}
+	return entry
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,153 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/tracyhatemice/gomailify/internal/dedup"
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+)
+
+var (
+	// ErrNotFound is returned by Reforward when the mailbox holds no
+	// message with the requested Message-ID.
+	ErrNotFound = errors.New("message not found in mailbox")
+
+	// ErrUnsupported is returned by Reforward when the receiver cannot look
+	// up messages by Message-ID.
+	ErrUnsupported = errors.New("receiver cannot look up messages")
+
+	// ErrNoFailure is returned by Retry when no delivery of the message
+	// failed.
+	ErrNoFailure = errors.New("no failed delivery of that message")
+
+	// ErrDryRun is returned by Reforward for an account in dry-run mode.
+	ErrDryRun = errors.New("account is in dry-run mode")
+)
+
+// PollNow asks the forwarder to check the mailbox right away, without
+// waiting for the poll interval or an error backoff. It reports false if a
+// check is already pending.
+func (f *Forwarder) PollNow() bool {
+	select {
+	case f.wake <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pause stops the forwarder from fetching and forwarding mail until Resume.
+// A delivery in progress completes. Mail fetched over IMAP IDLE while paused
+// is left on the server and picked up on resume.
+func (f *Forwarder) Pause() {
+	if !f.paused.Swap(true) {
+		f.logger.Info("paused", "account", f.account.Name)
+	}
+}
+
+// Resume undoes Pause and checks the mailbox right away.
+func (f *Forwarder) Resume() {
+	if f.paused.Swap(false) {
+		f.logger.Info("resumed", "account", f.account.Name)
+		f.PollNow()
+	}
+}
+
+// Paused reports whether the forwarder is paused.
+func (f *Forwarder) Paused() bool {
+	return f.paused.Load()
+}
+
+// Reforward looks up the message with the given Message-ID in the mailbox
+// and forwards it again, even if it was forwarded, filtered or dead-lettered
+// before. It works while the account is paused.
+func (f *Forwarder) Reforward(ctx context.Context, messageID string) (receiver.Email, error) {
+	if f.account.DryRun {
+		return receiver.Email{}, ErrDryRun
+	}
+	finder, ok := f.receiver.(receiver.Finder)
+	if !ok {
+		return receiver.Email{}, ErrUnsupported
+	}
+
+	f.fetchMu.Lock()
+	email, found, err := finder.Find(messageID)
+	f.fetchMu.Unlock()
+	if err != nil {
+		return receiver.Email{}, fmt.Errorf("look up message: %w", err)
+	}
+	if !found {
+		return receiver.Email{}, ErrNotFound
+	}
+
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	f.logger.Info("reforwarding on request", "account", f.account.Name, "msg_id", email.ID)
+	if err := f.forwardOne(ctx, email); err != nil {
+		return email, err
+	}
+	return email, nil
+}
+
+// Failures returns up to limit messages whose delivery failed or was given
+// up on, most recently updated first. limit <= 0 returns all of them.
+func (f *Forwarder) Failures(limit int) ([]dedup.Record, error) {
+	var recs []dedup.Record
+	err := f.tracker.ForEach(func(rec dedup.Record) error {
+		if rec.State == dedup.StateFailed || rec.State == dedup.StateDeadLettered {
+			recs = append(recs, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read dedup state: %w", err)
+	}
+	slices.SortFunc(recs, func(a, b dedup.Record) int {
+		return b.UpdatedAt.Compare(a.UpdatedAt)
+	})
+	if limit > 0 && len(recs) > limit {
+		recs = recs[:limit]
+	}
+	return recs, nil
+}
+
+// Retry makes the failed or dead-lettered message id eligible for delivery
+// again with a fresh count of attempts, and checks the mailbox right away so
+// it is forwarded if it is still there. It returns ErrNoFailure if id is not
+// in either state.
+func (f *Forwarder) Retry(id string) error {
+	ok, err := f.tracker.Retry(id)
+	if err != nil {
+		return fmt.Errorf("update dedup state: %w", err)
+	}
+	if !ok {
+		return ErrNoFailure
+	}
+	if fg, ok := f.receiver.(receiver.Forgetter); ok {
+		fg.Forget(id)
+	}
+	f.logger.Info("retrying on request", "account", f.account.Name, "msg_id", id)
+	f.PollNow()
+	return nil
+}
+
+// runWake serves PollNow for receivers that watch the mailbox themselves,
+// checking it with a one-shot fetch next to the watch.
+func (f *Forwarder) runWake(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.wake:
+		}
+		if f.Paused() {
+			continue
+		}
+		if _, err := f.poll(ctx); err != nil {
+			f.logger.Error("fetch failed", "account", f.account.Name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/tracyhatemice/gomailify/internal/metrics"
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+)
+
+// headers returns the raw From header and the decoded subject of a message,
+// or empty strings if its header cannot be parsed.
+func headers(raw []byte) (from, subject string) {
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return "", ""
+	}
+	defer mr.Close()
+	subject, _ = mr.Header.Subject()
+	return mr.Header.Get("From"), subject
+}
+
+// describe summarizes email for the record of recent deliveries.
+func describe(email receiver.Email) metrics.Delivery {
+	from, subject := headers(email.Content)
+	return metrics.Delivery{
+		ID:        email.ID,
+		MessageID: email.MessageID,
+		From:      from,
+		Subject:   subject,
+		Size:      len(email.Content),
+	}
+}
+
+// digestDelivery summarizes a digest of count messages.
+func digestDelivery(msg []byte, count int) metrics.Delivery {
+	return metrics.Delivery{
+		ID:      "digest",
+		Subject: fmt.Sprintf("Digest of %d message(s)", count),
+		Size:    len(msg),
+	}
+}
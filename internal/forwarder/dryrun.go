@@ -0,0 +1,129 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+)
+
+// Dry-run actions recorded in a DryRunEntry.
+const (
+	ActionForward = "forward"
+	ActionUrgent  = "forward (urgent)"
+	ActionHold    = "hold"
+	ActionDigest  = "queue for digest"
+)
+
+// DryRunEntry records what the forwarder would have done with one email.
+type DryRunEntry struct {
+	MsgID   string
+	Action  string
+	To      string
+	From    string // original From header
+	Subject string
+	Size    int
+}
+
+// DryRun reports whether the forwarder only evaluates emails without
+// sending them or marking them seen.
+func (f *Forwarder) DryRun() bool {
+	return f.account.DryRun
+}
+
+// DryRunReport returns the emails evaluated so far in dry-run mode, in the
+// order they were seen.
+func (f *Forwarder) DryRunReport() []DryRunEntry {
+	f.dryMu.Lock()
+	defer f.dryMu.Unlock()
+	return append([]DryRunEntry(nil), f.dryEntries...)
+}
+
+// evaluate logs what would happen to each email and records it in the
+// dry-run report. Evaluated IDs are remembered for the lifetime of the
+// process so each email is reported once.
+func (f *Forwarder) evaluate(emails []receiver.Email) {
+	closed := f.hours != nil && !f.hours.Open(time.Now())
+
+	for _, email := range emails {
+		action := ActionForward
+		switch {
+		case f.digest != nil:
+			action = ActionDigest
+		case closed && f.isUrgent(email):
+			action = ActionUrgent
+		case closed:
+			action = ActionHold
+		}
+
+		envFrom, message := f.sender.Preview(email.Content, email.OriginalID())
+		origFrom, subject := headerSummary(email.Content)
+		rewritten := rewrittenHeaders(message)
+
+		args := []any{
+			"account", f.account.Name,
+			"msg_id", email.ID,
+			"action", action,
+			"to", f.account.ForwardTo,
+			"envelope_from", envFrom,
+			"subject", subject,
+			"size", len(email.Content),
+		}
+		for _, h := range rewritten {
+			args = append(args, "header."+h[0], h[1])
+		}
+		if action == ActionHold {
+			args = append(args, "release_at", f.hours.NextOpen(time.Now()))
+		}
+		f.logger.Info("dry run: would "+action, args...)
+
+		f.dryMu.Lock()
+		f.dryEntries = append(f.dryEntries, DryRunEntry{
+			MsgID:   email.ID,
+			Action:  action,
+			To:      f.account.ForwardTo,
+			From:    origFrom,
+			Subject: subject,
+			Size:    len(email.Content),
+		})
+		f.drySeen[email.ID] = struct{}{}
+		f.dryMu.Unlock()
+	}
+}
+
+// headerSummary returns the From and Subject headers of a raw email.
+func headerSummary(raw []byte) (from, subject string) {
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return "", ""
+	}
+	defer mr.Close()
+	subject, _ = mr.Header.Subject()
+	return mr.Header.Get("From"), subject
+}
+
+// rewrittenHeaders returns the headers the sender adds or rewrites, as they
+// appear in the message that would be relayed.
+func rewrittenHeaders(message []byte) [][2]string {
+	mr, err := mail.CreateReader(bytes.NewReader(message))
+	if err != nil {
+		return nil
+	}
+	defer mr.Close()
+
+	var out [][2]string
+	for _, key := range []string{"From", "X-Forwarded-By", "X-Original-Message-ID", "X-Forwarded-Time"} {
+		if v := mr.Header.Get(key); v != "" {
+			out = append(out, [2]string{key, v})
+		}
+	}
+	return out
+}
+
+// String formats the entry as one line of the dry-run summary.
+func (e DryRunEntry) String() string {
+	return fmt.Sprintf("%-16s %s  %q from %s (%d bytes)", e.Action, e.MsgID, e.Subject, e.From, e.Size)
+}
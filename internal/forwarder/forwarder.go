@@ -3,15 +3,33 @@ package forwarder
 import (
 	"context"
 	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tracyhatemice/gomailify/internal/audit"
 	"github.com/tracyhatemice/gomailify/internal/config"
 	"github.com/tracyhatemice/gomailify/internal/dedup"
+	"github.com/tracyhatemice/gomailify/internal/digest"
+	"github.com/tracyhatemice/gomailify/internal/metrics"
 	"github.com/tracyhatemice/gomailify/internal/receiver"
+	"github.com/tracyhatemice/gomailify/internal/schedule"
 	"github.com/tracyhatemice/gomailify/internal/sender"
+	"github.com/tracyhatemice/gomailify/internal/spool"
+	"github.com/tracyhatemice/gomailify/internal/tracing"
 )
 
-const maxBackoffShift = 4 // multiplier caps at 1<<4 = 16×
+var tracer = otel.Tracer("github.com/tracyhatemice/gomailify/internal/forwarder")
+
+const (
+	maxBackoffShift = 4 // multiplier caps at 1<<4 = 16×
+	pruneInterval   = 24 * time.Hour
+)
 
 // Forwarder monitors one email account and forwards new messages.
 type Forwarder struct {
@@ -19,7 +37,51 @@ type Forwarder struct {
 	receiver receiver.Receiver
 	sender   *sender.Sender
 	tracker  *dedup.Tracker
+	shared   *dedup.Shared
+	metrics  *metrics.Account
+	audit    *audit.Log
 	logger   *slog.Logger
+	digest   *spool.Spool
+	held     *spool.Spool
+	hours    *schedule.Hours
+	urgent   []urgentRule
+
+	retention time.Duration
+
+	wake    chan struct{} // PollNow requests
+	paused  atomic.Bool
+	fetchMu sync.Mutex // serializes use of the receiver by the forwarder
+	sendMu  sync.Mutex // serializes batches of deliveries
+
+	dryMu      sync.Mutex
+	dryEntries []DryRunEntry
+	drySeen    map[string]struct{}
+}
+
+// Options holds optional collaborators of a Forwarder.
+type Options struct {
+	// Digest holds emails awaiting the next digest. Required when the
+	// account's delivery mode is "digest".
+	Digest *spool.Spool
+
+	// Held stores emails fetched outside the account's delivery windows.
+	// Required when the account has a schedule.
+	Held *spool.Spool
+
+	// Retention is how long dedup IDs are kept before pruning. Zero keeps
+	// them forever.
+	Retention time.Duration
+
+	// Shared, if set, deduplicates messages across all accounts that
+	// forward to the same destination.
+	Shared *dedup.Shared
+
+	// Metrics, if set, records the account's activity. It is also passed
+	// to the receiver if the receiver is observable.
+	Metrics *metrics.Account
+
+	// Audit, if set, records every message accepted by the SMTP server.
+	Audit *audit.Log
 }
 
 // New creates a Forwarder for the given account.
@@ -29,32 +91,84 @@ func New(
 	smtp *sender.Sender,
 	tracker *dedup.Tracker,
 	logger *slog.Logger,
+	opts Options,
 ) *Forwarder {
-	return &Forwarder{
+	f := &Forwarder{
 		account:  acct,
 		receiver: recv,
 		sender:   smtp,
 		tracker:  tracker,
+		shared:   opts.Shared,
+		metrics:  opts.Metrics,
+		audit:    opts.Audit,
 		logger:   logger,
+		digest:   opts.Digest,
+		held:     opts.Held,
+		drySeen:  make(map[string]struct{}),
+		wake:     make(chan struct{}, 1),
+
+		retention: opts.Retention,
+	}
+	if acct.Schedule != nil && opts.Held != nil {
+		// Both are validated at config load.
+		f.hours, _ = acct.Schedule.Hours()
+		f.urgent = compileUrgent(acct.Schedule.Urgent)
 	}
+	if opts.Metrics != nil {
+		if o, ok := recv.(receiver.Observable); ok {
+			o.Observe(opts.Metrics)
+		}
+		opts.Metrics.SetStoreSize(tracker.Count)
+	}
+	return f
+}
+
+// Name returns the name of the account this forwarder monitors.
+func (f *Forwarder) Name() string {
+	return f.account.Name
+}
+
+// ForwardTo returns the destination address of the account.
+func (f *Forwarder) ForwardTo() string {
+	return f.account.ForwardTo
 }
 
 // Run starts the forwarder. If the receiver supports IMAP IDLE (Watcher), it
 // uses push-based delivery. Otherwise it falls back to interval polling with
-// exponential backoff on consecutive errors.
+// exponential backoff on consecutive errors. It returns once ctx is cancelled
+// and every goroutine it started has finished, after which the receiver,
+// tracker and spools may be closed.
 func (f *Forwarder) Run(ctx context.Context) {
 	f.logger.Info("starting forwarder",
 		"account", f.account.Name,
 		"protocol", f.account.Protocol,
 		"host", f.account.Host,
+		"delivery", f.account.GetDelivery(),
+		"dry_run", f.account.DryRun,
 	)
 
+	var wg sync.WaitGroup
+	// Spooled mail from earlier runs must not be sent during a dry run.
+	if f.digest != nil && !f.account.DryRun {
+		wg.Go(func() { f.runDigest(ctx) })
+	}
+	if f.hours != nil && !f.account.DryRun {
+		wg.Go(func() { f.runRelease(ctx) })
+	}
+	if f.retention > 0 && !f.account.DryRun {
+		wg.Go(func() { f.runPrune(ctx) })
+	}
+
 	if w, ok := f.receiver.(receiver.Watcher); ok {
-		w.Watch(ctx, f.tracker.SeenIDs, f.account.GetProcessDays(), f.forwardEmails)
+		wg.Go(func() { f.runWake(ctx) })
+		w.Watch(ctx, f.isSeen, f.account.GetProcessDays(), func(ctx context.Context, emails []receiver.Email) {
+			f.forwardEmails(ctx, emails)
+		})
 	} else {
 		f.runPoller(ctx)
 	}
 
+	wg.Wait()
 	f.logger.Info("forwarder stopped", "account", f.account.Name)
 }
 
@@ -65,7 +179,9 @@ func (f *Forwarder) runPoller(ctx context.Context) {
 
 	errCount := 0
 	for {
-		if err := f.poll(); err != nil {
+		if f.Paused() {
+			f.logger.Debug("paused, skipping poll", "account", f.account.Name)
+		} else if _, err := f.poll(ctx); err != nil {
 			f.logger.Error("fetch failed", "account", f.account.Name, "error", err)
 			errCount++
 			f.logger.Warn("backing off",
@@ -77,56 +193,463 @@ func (f *Forwarder) runPoller(ctx context.Context) {
 			errCount = 0
 		}
 
+		wait := backoff(base, errCount)
+		f.metrics.SetBackoff(wait)
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(backoff(base, errCount)):
+		case <-time.After(wait):
+		case <-f.wake:
 		}
 	}
 }
 
-// poll fetches and forwards new emails. Returns an error on fetch failure.
-func (f *Forwarder) poll() error {
+// poll fetches and forwards new emails, returning the number that could not
+// be forwarded. Returns an error on fetch failure.
+func (f *Forwarder) poll(ctx context.Context) (failed int, err error) {
 	f.logger.Debug("polling", "account", f.account.Name)
-	emails, err := f.receiver.Fetch(f.tracker.SeenIDs(), f.account.GetProcessDays())
+	ctx, span := tracer.Start(ctx, "forwarder.poll", trace.WithAttributes(attribute.String("account", f.account.Name)))
+	defer func() { tracing.End(span, err) }()
+
+	f.fetchMu.Lock()
+	emails, err := f.receiver.Fetch(ctx, f.isSeen, f.account.GetProcessDays())
+	f.fetchMu.Unlock()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if len(emails) > 0 {
-		f.forwardEmails(emails)
+		failed = f.forwardEmails(ctx, emails)
 	} else {
 		f.logger.Debug("no new emails", "account", f.account.Name)
 	}
-	return nil
+	return failed, nil
 }
 
-func (f *Forwarder) forwardEmails(emails []receiver.Email) {
+// forwardEmails sends each email in turn. The sender may block to honour rate
+// limits, so a large backlog drains gradually; cancelling ctx abandons the
+// rest of the batch, which is picked up again on the next start. Batches run
+// one at a time, and emails settled by an earlier batch are dropped, since
+// a poll requested with PollNow may overlap the receiver's own watch. It
+// returns the number of emails that could not be forwarded.
+func (f *Forwarder) forwardEmails(ctx context.Context, emails []receiver.Email) (failed int) {
+	ctx, span := tracer.Start(ctx, "forwarder.forward_emails", trace.WithAttributes(
+		attribute.String("account", f.account.Name),
+		attribute.Int("count", len(emails)),
+	))
+	defer span.End()
+
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	if f.Paused() {
+		f.logger.Info("paused, leaving new emails on the server", "account", f.account.Name, "count", len(emails))
+		return 0
+	}
+	emails = slices.DeleteFunc(emails, func(email receiver.Email) bool { return f.isSeen(email.ID) })
+	if len(emails) == 0 {
+		return 0
+	}
+	if f.account.DryRun {
+		f.evaluate(emails)
+		return 0
+	}
+	f.discover(emails)
+	if emails = f.claim(emails); len(emails) == 0 {
+		return 0
+	}
+	if f.digest != nil {
+		f.queueDigest(emails)
+		return 0
+	}
+	if f.hours != nil && !f.hours.Open(time.Now()) {
+		if emails = f.hold(emails); len(emails) == 0 {
+			return 0
+		}
+	}
+
 	f.logger.Info("forwarding new emails", "account", f.account.Name, "count", len(emails))
 	for _, email := range emails {
-		if err := f.sender.Forward(email.Content, f.account.ForwardTo, email.ID); err != nil {
+		if err := f.forwardOne(ctx, email); err != nil {
+			failed++
+			if ctx.Err() != nil {
+				return failed
+			}
+		}
+	}
+	return failed
+}
+
+// forwardOne sends a single email and records each step of its delivery
+// state, logging the outcome. A delivery interrupted by cancellation is left
+// in the forwarding state and recovered on the next start.
+func (f *Forwarder) forwardOne(ctx context.Context, email receiver.Email) (err error) {
+	ctx, span := tracer.Start(ctx, "forwarder.forward", trace.WithAttributes(
+		attribute.String("msg_id", email.ID),
+		attribute.String("message_id", email.MessageID),
+		attribute.Int("size", len(email.Content)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	if err := f.tracker.Forwarding(email.ID, f.account.ForwardTo); err != nil {
+		f.logger.Error("record delivery state failed",
+			"account", f.account.Name,
+			"msg_id", email.ID,
+			"error", err,
+		)
+		return err
+	}
+
+	receipt, err := f.sender.Forward(ctx, email.Content, f.account.ForwardTo, email.OriginalID())
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		f.metrics.ForwardFailed(describe(email), err)
+		f.release(email)
+		state, serr := f.tracker.Failed(email.ID, err, f.account.GetMaxAttempts())
+		if serr != nil {
+			f.logger.Error("record delivery state failed",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"error", serr,
+			)
+		}
+		if state == dedup.StateDeadLettered {
+			f.unhold(email.ID)
+			f.metrics.DeadLettered()
+			f.logger.Error("forward failed, giving up",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"attempts", f.account.GetMaxAttempts(),
+				"error", err,
+			)
+		} else {
 			f.logger.Error("forward failed",
 				"account", f.account.Name,
 				"msg_id", email.ID,
 				"error", err,
 			)
+		}
+		return err
+	}
+
+	f.unhold(email.ID)
+	d := describe(email)
+	f.metrics.Forwarded(d)
+	f.record(audit.Record{
+		Kind:      audit.KindMessage,
+		ID:        email.ID,
+		MessageID: email.MessageID,
+		From:      d.From,
+		Subject:   d.Subject,
+		Size:      d.Size,
+	}, receipt)
+	f.delivered(email)
+	if err := f.tracker.Forwarded(email.ID); err != nil {
+		f.logger.Error("mark seen failed",
+			"account", f.account.Name,
+			"msg_id", email.ID,
+			"error", err,
+		)
+		return err
+	}
+	f.logger.Info("forwarded",
+		"account", f.account.Name,
+		"msg_id", email.ID,
+		"to", f.account.ForwardTo,
+		"queue_id", receipt.QueueID,
+	)
+	return nil
+}
+
+// record adds a message accepted by the SMTP server to the audit log, if
+// there is one. A failure is logged; the message has been delivered either
+// way.
+func (f *Forwarder) record(rec audit.Record, receipt sender.Receipt) {
+	if f.audit == nil {
+		return
+	}
+	rec.Time = time.Now()
+	rec.Account = f.account.Name
+	rec.To = f.account.ForwardTo
+	rec.Reply = receipt.Reply
+	rec.QueueID = receipt.QueueID
+	if err := f.audit.Write(rec); err != nil {
+		f.logger.Error("write audit record failed",
+			"account", f.account.Name,
+			"msg_id", rec.ID,
+			"error", err,
+		)
+	}
+}
+
+// discover creates a delivery record for each newly fetched email.
+func (f *Forwarder) discover(emails []receiver.Email) {
+	for _, email := range emails {
+		if err := f.tracker.Discovered(email.ID, f.account.ForwardTo); err != nil {
+			f.logger.Error("record delivery state failed",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"error", err,
+			)
+		}
+	}
+}
+
+// isSeen reports whether the receiver should skip id: it was already
+// forwarded, is waiting in the digest or held spools, or was already reported
+// in dry-run mode. If the dedup store cannot be read the email is skipped for
+// now rather than risk forwarding it twice; the next poll retries.
+func (f *Forwarder) isSeen(id string) bool {
+	seen, err := f.tracker.Seen(id)
+	if err != nil {
+		f.logger.Error("dedup lookup failed", "account", f.account.Name, "msg_id", id, "error", err)
+		return true
+	}
+	if seen {
+		return true
+	}
+	for _, sp := range []*spool.Spool{f.digest, f.held} {
+		if sp != nil && sp.Has(id) {
+			return true
+		}
+	}
+	f.dryMu.Lock()
+	defer f.dryMu.Unlock()
+	_, seen = f.drySeen[id]
+	return seen
+}
+
+// runPrune periodically forgets dedup IDs older than the retention window.
+func (f *Forwarder) runPrune(ctx context.Context) {
+	for {
+		f.prune()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pruneInterval):
+		}
+	}
+}
+
+// prune forgets dedup IDs older than the retention window. If the receiver
+// needs the records of messages still in the mailbox, those are kept, and
+// nothing is pruned until the mailbox has been listed once.
+func (f *Forwarder) prune() {
+	var keep func(id string) bool
+	if r, ok := f.receiver.(receiver.Retainer); ok {
+		onServer := r.OnServer()
+		if onServer == nil {
+			f.logger.Debug("mailbox not listed yet, skipping dedup prune", "account", f.account.Name)
+			return
+		}
+		keep = func(id string) bool {
+			_, ok := onServer[id]
+			return ok
+		}
+	}
+	removed, err := f.tracker.Prune(f.retention, keep)
+	if err != nil {
+		f.logger.Error("dedup prune failed", "account", f.account.Name, "error", err)
+	} else if removed > 0 {
+		f.logger.Info("pruned dedup state",
+			"account", f.account.Name,
+			"removed", removed,
+			"remaining", f.tracker.Count(),
+		)
+	}
+}
+
+// queueDigest stores emails in the digest spool until the next scheduled digest.
+func (f *Forwarder) queueDigest(emails []receiver.Email) {
+	for _, email := range emails {
+		if err := f.digest.Add(email); err != nil {
+			f.logger.Error("queue for digest failed",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"error", err,
+			)
 			continue
 		}
+		f.logger.Info("queued for digest", "account", f.account.Name, "msg_id", email.ID)
+	}
+}
+
+// runDigest sends the accumulated digest each time the schedule fires.
+func (f *Forwarder) runDigest(ctx context.Context) {
+	cron, err := schedule.ParseCron(f.account.GetDigestSchedule())
+	if err != nil {
+		// Validated at config load; unreachable in practice.
+		f.logger.Error("invalid digest schedule", "account", f.account.Name, "error", err)
+		return
+	}
+
+	for {
+		next := cron.Next(time.Now())
+		if next.IsZero() {
+			// Rejected at config load; never fire rather than spin.
+			f.logger.Error("digest schedule never matches", "account", f.account.Name)
+			<-ctx.Done()
+			return
+		}
+		f.logger.Debug("next digest scheduled", "account", f.account.Name, "at", next)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		f.sendDigest(ctx)
+	}
+}
+
+// sendDigest bundles every spooled email into one digest message. The
+// included IDs are marked seen and removed from the spool only after the
+// digest has been accepted by the SMTP server. A digest that fails counts as
+// a delivery attempt of each email in it, and emails that use up
+// max_attempts are dead-lettered and leave the spool. It returns an error if
+// the digest could not be built or sent. The time of a digest sent, or found
+// to be empty, is recorded in the spool for RunOnce.
+func (f *Forwarder) sendDigest(ctx context.Context) error {
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	if f.Paused() {
+		f.logger.Info("paused, skipping digest", "account", f.account.Name)
+		return nil
+	}
+	now := time.Now()
+	emails, err := f.digest.List()
+	if err != nil {
+		f.logger.Error("read digest spool failed", "account", f.account.Name, "error", err)
+		return err
+	}
+	// Emails already settled were sent in a digest that the process did not
+	// get to remove them from, or were reforwarded.
+	emails = slices.DeleteFunc(emails, func(email receiver.Email) bool {
+		done, err := f.tracker.Seen(email.ID)
+		if err != nil || !done {
+			return false
+		}
+		f.logger.Info("already settled, dropping from digest", "account", f.account.Name, "msg_id", email.ID)
+		f.undigest(email.ID)
+		return true
+	})
+	if len(emails) == 0 {
+		f.logger.Debug("digest empty, nothing to send", "account", f.account.Name)
+		f.digestFlushed(now)
+		return nil
+	}
+
+	msg, err := digest.Build(f.account.Name, f.sender.Address(), f.account.ForwardTo, emails, now)
+	if err != nil {
+		f.logger.Error("build digest failed", "account", f.account.Name, "error", err)
+		return err
+	}
+	for _, email := range emails {
+		if err := f.tracker.Forwarding(email.ID, f.account.ForwardTo); err != nil {
+			f.logger.Error("record delivery state failed",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"error", err,
+			)
+		}
+	}
+	receipt, err := f.sender.Send(ctx, msg, f.account.ForwardTo)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		f.metrics.ForwardFailed(digestDelivery(msg, len(emails)), err)
+		f.logger.Error("send digest failed",
+			"account", f.account.Name,
+			"count", len(emails),
+			"error", err,
+		)
+		f.digestFailed(emails, err)
+		return err
+	}
+	d := digestDelivery(msg, len(emails))
+	f.metrics.Forwarded(d)
+	ids := make([]string, len(emails))
+	for i, email := range emails {
+		ids[i] = email.ID
+	}
+	f.record(audit.Record{
+		Kind:    audit.KindDigest,
+		IDs:     ids,
+		Subject: d.Subject,
+		Size:    d.Size,
+	}, receipt)
+
+	for _, email := range emails {
+		f.delivered(email)
 		if err := f.tracker.MarkSeen(email.ID); err != nil {
 			f.logger.Error("mark seen failed",
 				"account", f.account.Name,
 				"msg_id", email.ID,
 				"error", err,
 			)
+		}
+		// Delivered either way; leaving it would send it again.
+		f.undigest(email.ID)
+	}
+	f.digestFlushed(now)
+	f.logger.Info("digest sent",
+		"account", f.account.Name,
+		"count", len(emails),
+		"to", f.account.ForwardTo,
+	)
+	return nil
+}
+
+// digestFailed records a failed digest as a failed delivery attempt of each
+// of emails, and dead-letters those that have used up their attempts. Emails
+// still spooled keep their cross-account claims.
+func (f *Forwarder) digestFailed(emails []receiver.Email, cause error) {
+	dead := 0
+	for _, email := range emails {
+		state, err := f.tracker.Failed(email.ID, cause, f.account.GetMaxAttempts())
+		if err != nil {
+			f.logger.Error("record delivery state failed",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"error", err,
+			)
 			continue
 		}
-		f.logger.Info("forwarded",
+		if state == dedup.StateDeadLettered {
+			f.logger.Error("digest failed, giving up on email",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"attempts", f.account.GetMaxAttempts(),
+			)
+			f.undigest(email.ID)
+			f.release(email)
+			dead++
+		}
+	}
+	if dead > 0 {
+		f.metrics.DeadLettered()
+	}
+}
+
+// undigest removes id from the digest spool.
+func (f *Forwarder) undigest(id string) {
+	if err := f.digest.Remove(id); err != nil {
+		f.logger.Error("remove from digest spool failed",
 			"account", f.account.Name,
-			"msg_id", email.ID,
-			"to", f.account.ForwardTo,
+			"msg_id", id,
+			"error", err,
 		)
 	}
 }
 
+// digestFlushed records t as the time of the last digest.
+func (f *Forwarder) digestFlushed(t time.Time) {
+	if err := f.digest.SetFlushed(t); err != nil {
+		f.logger.Error("record digest time failed", "account", f.account.Name, "error", err)
+	}
+}
+
 // backoff returns base * 2^errCount, capped at base * (1 << maxBackoffShift).
 func backoff(base time.Duration, errCount int) time.Duration {
 	if errCount <= 0 {
@@ -0,0 +1,154 @@
+package forwarder
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/tracyhatemice/gomailify/internal/config"
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+)
+
+// urgentRule is a compiled config.UrgentRule. A nil pattern matches anything.
+type urgentRule struct {
+	from    *regexp.Regexp
+	subject *regexp.Regexp
+}
+
+func compileUrgent(rules []config.UrgentRule) []urgentRule {
+	out := make([]urgentRule, 0, len(rules))
+	for _, r := range rules {
+		var u urgentRule
+		if r.From != "" {
+			u.from = regexp.MustCompile(r.From)
+		}
+		if r.Subject != "" {
+			u.subject = regexp.MustCompile(r.Subject)
+		}
+		out = append(out, u)
+	}
+	return out
+}
+
+// isUrgent reports whether email matches any urgent rule and should bypass
+// the delivery schedule.
+func (f *Forwarder) isUrgent(email receiver.Email) bool {
+	if len(f.urgent) == 0 {
+		return false
+	}
+
+	from, subject := headers(email.Content)
+
+	for _, r := range f.urgent {
+		if r.from != nil && !r.from.MatchString(from) {
+			continue
+		}
+		if r.subject != nil && !r.subject.MatchString(subject) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// hold stores non-urgent emails in the held spool until the next delivery
+// window opens, and returns the urgent ones to be forwarded right away.
+// Emails that cannot be spooled are returned too rather than dropped.
+func (f *Forwarder) hold(emails []receiver.Email) []receiver.Email {
+	var now []receiver.Email
+	for _, email := range emails {
+		if f.isUrgent(email) {
+			f.logger.Info("urgent, bypassing schedule", "account", f.account.Name, "msg_id", email.ID)
+			now = append(now, email)
+			continue
+		}
+		if err := f.held.Add(email); err != nil {
+			f.logger.Error("hold failed, forwarding now",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"error", err,
+			)
+			now = append(now, email)
+			continue
+		}
+		f.logger.Info("outside delivery window, held",
+			"account", f.account.Name,
+			"msg_id", email.ID,
+			"release_at", f.hours.NextOpen(time.Now()),
+		)
+	}
+	return now
+}
+
+// runRelease forwards held emails whenever a delivery window is open.
+func (f *Forwarder) runRelease(ctx context.Context) {
+	for {
+		wait := time.Until(f.hours.NextOpen(time.Now()))
+		if wait <= 0 {
+			f.releaseHeld(ctx)
+			wait = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// releaseHeld forwards every held email, oldest first, and returns the
+// number that could not be forwarded. Emails that fail stay held and are
+// retried on the next pass, until they are dead-lettered. Emails already
+// settled, such as by a reforward, are dropped unsent.
+func (f *Forwarder) releaseHeld(ctx context.Context) (failed int) {
+	if f.held.Len() == 0 {
+		return 0
+	}
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	if f.Paused() {
+		return 0
+	}
+	emails, err := f.held.List()
+	if err != nil {
+		f.logger.Error("read held spool failed", "account", f.account.Name, "error", err)
+		return f.held.Len()
+	}
+
+	f.logger.Info("delivery window open, releasing held emails", "account", f.account.Name, "count", len(emails))
+	for _, email := range emails {
+		done, err := f.tracker.Seen(email.ID)
+		if err != nil {
+			f.logger.Error("dedup lookup failed", "account", f.account.Name, "msg_id", email.ID, "error", err)
+			failed++
+			continue
+		}
+		if done {
+			f.logger.Info("already settled, dropping held email", "account", f.account.Name, "msg_id", email.ID)
+			f.unhold(email.ID)
+			continue
+		}
+		if err := f.forwardOne(ctx, email); err != nil {
+			failed++
+			if ctx.Err() != nil {
+				return failed
+			}
+		}
+	}
+	return failed
+}
+
+// unhold removes id from the held spool, if it is there, once it needs no
+// further delivery: the SMTP server accepted it or it was dead-lettered.
+func (f *Forwarder) unhold(id string) {
+	if f.held == nil {
+		return
+	}
+	if err := f.held.Remove(id); err != nil {
+		f.logger.Error("remove from held spool failed",
+			"account", f.account.Name,
+			"msg_id", id,
+			"error", err,
+		)
+	}
+}
@@ -0,0 +1,81 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tracyhatemice/gomailify/internal/schedule"
+)
+
+// RunOnce performs a single check of the mailbox and returns when everything
+// it found has been handled, for runs driven by an external timer such as
+// cron. It always fetches with Fetch, even from a receiver that supports IMAP
+// IDLE. Held emails are released first if a delivery window is open, and a
+// digest account sends the digest of everything spooled if its schedule came
+// due since the last digest. It returns an error if the mailbox could not be
+// checked or any email could not be forwarded.
+func (f *Forwarder) RunOnce(ctx context.Context) error {
+	f.logger.Info("checking mailbox once",
+		"account", f.account.Name,
+		"protocol", f.account.Protocol,
+		"host", f.account.Host,
+		"delivery", f.account.GetDelivery(),
+		"dry_run", f.account.DryRun,
+	)
+
+	failed := 0
+	if f.hours != nil && !f.account.DryRun && f.hours.Open(time.Now()) {
+		failed += f.releaseHeld(ctx)
+	}
+
+	var errs []error
+	n, err := f.poll(ctx)
+	failed += n
+	if err != nil {
+		errs = append(errs, fmt.Errorf("fetch: %w", err))
+	}
+	// After the poll, so a receiver that keeps the records of messages
+	// still on the server has listed them.
+	if f.retention > 0 && !f.account.DryRun {
+		f.prune()
+	}
+
+	if f.digest != nil && !f.account.DryRun && ctx.Err() == nil {
+		due, err := f.digestDue(time.Now())
+		if err == nil && due {
+			err = f.sendDigest(ctx)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("digest: %w", err))
+		}
+	}
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("%d email(s) could not be forwarded", failed))
+	}
+	return errors.Join(errs...)
+}
+
+// digestDue reports whether the digest schedule came due between the last
+// digest and now. Without a recorded digest, the schedule starts at now.
+func (f *Forwarder) digestDue(now time.Time) (bool, error) {
+	last, err := f.digest.Flushed()
+	if err != nil {
+		return false, err
+	}
+	if last.IsZero() {
+		f.logger.Info("no digest sent yet, starting the digest schedule", "account", f.account.Name)
+		return false, f.digest.SetFlushed(now)
+	}
+	cron, err := schedule.ParseCron(f.account.GetDigestSchedule())
+	if err != nil {
+		return false, err
+	}
+	next := cron.Next(last)
+	if next.IsZero() || next.After(now) {
+		f.logger.Info("digest not due", "account", f.account.Name, "next", next)
+		return false, nil
+	}
+	return true, nil
+}
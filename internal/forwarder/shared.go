@@ -0,0 +1,119 @@
+package forwarder
+
+import (
+	"github.com/tracyhatemice/gomailify/internal/dedup"
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+	"github.com/tracyhatemice/gomailify/internal/spool"
+)
+
+// claim returns the emails this account may deliver under cross-account
+// dedup. Copies another account already delivered to the same destination
+// are recorded as filtered; copies another account is still delivering are
+// left alone and reconsidered on a later fetch. Emails without a Message-ID
+// cannot be matched across accounts and are always kept.
+func (f *Forwarder) claim(emails []receiver.Email) []receiver.Email {
+	if f.shared == nil {
+		return emails
+	}
+
+	kept := emails[:0:0]
+	for _, email := range emails {
+		if email.MessageID == "" {
+			kept = append(kept, email)
+			continue
+		}
+		result, owner, err := f.shared.Claim(f.account.ForwardTo, email.MessageID, f.account.Name)
+		switch {
+		case err != nil:
+			// Skip for now rather than risk a duplicate; the next fetch retries.
+			f.logger.Error("shared dedup lookup failed",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"error", err,
+			)
+		case result == dedup.ClaimDuplicate:
+			f.logger.Info("already forwarded by another account, skipping",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"forwarded_by", owner,
+			)
+			f.metrics.Filtered("duplicate", 1)
+			if err := f.tracker.Filtered(email.ID, "duplicate of "+owner); err != nil {
+				f.logger.Error("record delivery state failed",
+					"account", f.account.Name,
+					"msg_id", email.ID,
+					"error", err,
+				)
+			}
+		case result == dedup.ClaimPending:
+			f.logger.Debug("being forwarded by another account, deferring",
+				"account", f.account.Name,
+				"msg_id", email.ID,
+				"claimed_by", owner,
+			)
+		default:
+			kept = append(kept, email)
+		}
+	}
+	return kept
+}
+
+// delivered settles this account's cross-account claim on email.
+func (f *Forwarder) delivered(email receiver.Email) {
+	if f.shared == nil || email.MessageID == "" {
+		return
+	}
+	if err := f.shared.Delivered(f.account.ForwardTo, email.MessageID); err != nil {
+		f.logger.Error("record shared dedup state failed",
+			"account", f.account.Name,
+			"msg_id", email.ID,
+			"error", err,
+		)
+	}
+}
+
+// release gives up this account's cross-account claim on email after a failed
+// delivery, so another account's copy may be forwarded instead.
+func (f *Forwarder) release(email receiver.Email) {
+	if f.shared == nil || email.MessageID == "" {
+		return
+	}
+	if err := f.shared.Release(f.account.ForwardTo, email.MessageID); err != nil {
+		f.logger.Error("record shared dedup state failed",
+			"account", f.account.Name,
+			"msg_id", email.ID,
+			"error", err,
+		)
+	}
+}
+
+// ReleaseClaims gives up the cross-account claims this account left in flight
+// when it last stopped, keeping those on emails still waiting in its digest or
+// held spools. It is called before Run.
+func (f *Forwarder) ReleaseClaims() {
+	if f.shared == nil || f.account.DryRun {
+		return
+	}
+	var keep []string
+	for _, sp := range []*spool.Spool{f.digest, f.held} {
+		if sp == nil {
+			continue
+		}
+		emails, err := sp.List()
+		if err != nil {
+			// Keep every claim rather than let another account forward a
+			// spooled message.
+			f.logger.Error("read spool failed, keeping cross-account claims", "account", f.account.Name, "error", err)
+			return
+		}
+		for _, email := range emails {
+			keep = append(keep, email.MessageID)
+		}
+	}
+	n, err := f.shared.ReleaseOwner(f.account.Name, f.account.ForwardTo, keep)
+	if err != nil {
+		f.logger.Error("release cross-account claims failed", "account", f.account.Name, "error", err)
+	} else if n > 0 {
+		f.logger.Warn("released cross-account claims interrupted by previous shutdown", "account", f.account.Name, "count", n)
+	}
+}
@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File is a log file that is rotated when it grows past a size limit. The
+// current file is renamed to path.1, the previous path.1 to path.2 and so
+// on; the oldest beyond the number of backups is removed.
+type File struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64 // bytes; 0 never rotates
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// OpenFile opens or creates the log file at path for appending.
+func OpenFile(path string, maxSize int64, maxBackups int) (*File, error) {
+	lf := &File{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat log file: %w", err)
+	}
+	lf.f, lf.size = f, info.Size()
+	return nil
+}
+
+// Write appends p to the file, first rotating it if p would take it past
+// the size limit. A single write is never split across files.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.maxSize > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.maxSize {
+		if err := lf.rotate(); err != nil {
+			// Keep logging to the old file rather than lose records.
+			fmt.Fprintf(os.Stderr, "rotate log file: %v\n", err)
+		}
+	}
+	if lf.f == nil {
+		if err := lf.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, shifts the backups and reopens path.
+// lf.mu must be held.
+func (lf *File) rotate() error {
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	lf.f = nil
+	if lf.maxBackups == 0 {
+		if err := os.Remove(lf.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := lf.maxBackups - 1; i >= 1; i-- {
+			err := os.Rename(lf.backup(i), lf.backup(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(lf.path, lf.backup(1)); err != nil {
+			return err
+		}
+	}
+	return lf.open()
+}
+
+func (lf *File) backup(i int) string {
+	return fmt.Sprintf("%s.%d", lf.path, i)
+}
+
+// Close closes the file.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
@@ -0,0 +1,127 @@
+// Package logging provides the slog handler behind the daemon's logger: it
+// applies per-account log levels and writes to a size-rotated file.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync/atomic"
+)
+
+// AccountKey is the attribute that names the account a record is about.
+const AccountKey = "account"
+
+// Levels holds the minimum level of records to log, overall and per account.
+// It is safe for concurrent use and can be changed while logging. The zero
+// value logs at slog.LevelInfo.
+type Levels struct {
+	set atomic.Pointer[levelSet]
+}
+
+type levelSet struct {
+	base     slog.Level
+	min      slog.Level // lowest of base and every account level
+	accounts map[string]slog.Level
+}
+
+// Set replaces the levels. Records about an account in accounts are logged
+// at its level; all others at base.
+func (l *Levels) Set(base slog.Level, accounts map[string]slog.Level) {
+	s := &levelSet{base: base, min: base, accounts: accounts}
+	for _, lvl := range accounts {
+		s.min = min(s.min, lvl)
+	}
+	l.set.Store(s)
+}
+
+// Level returns the level of records about account, or the base level if
+// account is empty or has no level of its own.
+func (l *Levels) Level(account string) slog.Level {
+	s := l.set.Load()
+	if s == nil {
+		return slog.LevelInfo
+	}
+	if lvl, ok := s.accounts[account]; ok {
+		return lvl
+	}
+	return s.base
+}
+
+func (l *Levels) min() slog.Level {
+	s := l.set.Load()
+	if s == nil {
+		return slog.LevelInfo
+	}
+	return s.min
+}
+
+// Handler filters records by the level of the account they are about, taken
+// from the AccountKey attribute, and passes the rest to another handler.
+type Handler struct {
+	inner   slog.Handler
+	levels  *Levels
+	account string // set by WithAttrs; empty if unknown
+	grouped bool   // record attributes belong to a group, so name no account
+}
+
+// NewHandler returns a handler that filters records by levels and writes
+// them with inner. The level inner was created with is ignored.
+func NewHandler(inner slog.Handler, levels *Levels) *Handler {
+	return &Handler{inner: inner, levels: levels}
+}
+
+// HandlerOptions returns options for inner handlers of NewHandler, which must
+// accept every level since Handler does the filtering.
+func HandlerOptions() *slog.HandlerOptions {
+	return &slog.HandlerOptions{Level: slog.Level(math.MinInt)}
+}
+
+// Enabled reports whether some account might log at level. The record's own
+// attributes are not known yet, so Handle makes the final decision.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.account != "" {
+		return level >= h.levels.Level(h.account)
+	}
+	return level >= h.levels.min()
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	account := h.account
+	if account == "" && !h.grouped {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == AccountKey {
+				account = a.Value.String()
+				return false
+			}
+			return true
+		})
+	}
+	if r.Level < h.levels.Level(account) {
+		return nil
+	}
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.inner = h.inner.WithAttrs(attrs)
+	if !h.grouped {
+		for _, a := range attrs {
+			if a.Key == AccountKey {
+				h2.account = a.Value.String()
+			}
+		}
+	}
+	return &h2
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.inner = h.inner.WithGroup(name)
+	h2.grouped = true
+	return &h2
+}
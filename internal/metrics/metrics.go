@@ -0,0 +1,535 @@
+// Package metrics exposes per-account counters and gauges in the Prometheus
+// text format, and keeps the status of each account for health checks.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+	"github.com/tracyhatemice/gomailify/internal/sender"
+)
+
+const (
+	namespace = "gomailify"
+
+	// recentErrors is the number of errors kept per account for Errors.
+	recentErrors = 20
+
+	// recentDeliveries is the number of deliveries kept per account for
+	// Deliveries.
+	recentDeliveries = 20
+)
+
+// Metrics holds the collectors of every account. A nil *Metrics is valid and
+// records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	fetches        *prometheus.CounterVec
+	fetchErrors    *prometheus.CounterVec
+	fetchDuration  *prometheus.HistogramVec
+	found          *prometheus.CounterVec
+	fresh          *prometheus.CounterVec
+	filtered       *prometheus.CounterVec
+	forwards       *prometheus.CounterVec
+	forwardedBytes *prometheus.CounterVec
+	reconnects     *prometheus.CounterVec
+
+	mu         sync.Mutex
+	accounts   map[string]*Account
+	sharedSize func() int
+}
+
+// Account records the metrics of one account. A nil *Account is valid and
+// records nothing, so callers need not check whether metrics are enabled.
+type Account struct {
+	name string
+	m    *Metrics
+
+	mu            sync.Mutex
+	idleSince     time.Time // zero while not in IDLE
+	backoff       time.Duration
+	storeSize     func() int
+	lastFetch     time.Time
+	lastForward   time.Time
+	fetchErrors   int // consecutive failed mailbox checks
+	forwardErrors int // consecutive failed deliveries still being retried
+	authFailed    bool
+	lastError     string
+	lastErrorAt   time.Time
+	errors        []ErrorEvent // most recent last, at most recentErrors
+	deliveries    []Delivery   // most recent last, at most recentDeliveries
+}
+
+// Delivery describes one message the account forwarded or failed to forward.
+type Delivery struct {
+	Time      time.Time `json:"time"`
+	ID        string    `json:"id"` // dedup key
+	MessageID string    `json:"message_id,omitempty"`
+	From      string    `json:"from,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Size      int       `json:"size"`
+	Error     string    `json:"error,omitempty"` // empty if the relay accepted it
+}
+
+// ErrorEvent is one failure of an account.
+type ErrorEvent struct {
+	Time    time.Time `json:"time"`
+	Account string    `json:"account"`
+	Op      string    `json:"op"`               // "fetch", "session" or "forward"
+	MsgID   string    `json:"msg_id,omitempty"` // the message, for forward errors
+	Error   string    `json:"error"`
+}
+
+// Status is a snapshot of an account's recent activity.
+type Status struct {
+	Account                  string    `json:"account"`
+	LastFetch                time.Time `json:"last_fetch,omitzero"`   // last successful mailbox check
+	LastForward              time.Time `json:"last_forward,omitzero"` // last successful delivery
+	ConsecutiveFetchErrors   int       `json:"consecutive_fetch_errors"`
+	ConsecutiveForwardErrors int       `json:"consecutive_forward_errors"`
+	AuthFailed               bool      `json:"auth_failed"` // the last mailbox check failed to log in
+	LastError                string    `json:"last_error,omitempty"`
+	LastErrorAt              time.Time `json:"last_error_at,omitzero"`
+	IdleConnected            bool      `json:"idle_connected"`
+	DedupRecords             int       `json:"dedup_records"` // -1 if unknown
+}
+
+// New creates the collectors and registers them, along with the Go runtime
+// and process collectors, in a fresh registry.
+func New() *Metrics {
+	account := []string{"account"}
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		fetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fetch_attempts_total",
+			Help:      "Mailbox checks attempted.",
+		}, account),
+		fetchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fetch_errors_total",
+			Help:      "Mailbox checks that failed.",
+		}, account),
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "fetch_duration_seconds",
+			Help:      "Time taken by each mailbox check, including downloads.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, account),
+		found: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_found_total",
+			Help:      "Messages found on the server by mailbox checks.",
+		}, account),
+		fresh: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_new_total",
+			Help:      "Messages found that had not been seen before.",
+		}, account),
+		filtered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_filtered_total",
+			Help:      "Messages found that were not forwarded, by reason.",
+		}, []string{"account", "reason"}),
+		forwards: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "forwards_total",
+			Help:      "Delivery attempts to the destination, by result and SMTP reply class.",
+		}, []string{"account", "result", "class"}),
+		forwardedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "forwarded_bytes_total",
+			Help:      "Size of the messages delivered.",
+		}, account),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "idle_reconnects_total",
+			Help:      "Persistent IMAP sessions that failed and were reconnected.",
+		}, account),
+		accounts: make(map[string]*Account),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.fetches, m.fetchErrors, m.fetchDuration,
+		m.found, m.fresh, m.filtered,
+		m.forwards, m.forwardedBytes, m.reconnects,
+		gauges{m},
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Account returns the metrics of the named account, creating them on first
+// use. An account that is restarted keeps its counters.
+func (m *Metrics) Account(name string) *Account {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.accounts[name]
+	if !ok {
+		a = &Account{name: name, m: m}
+		m.accounts[name] = a
+		// Export the counters from the start, so rates and alerts work
+		// before the first event.
+		for _, c := range []*prometheus.CounterVec{m.fetches, m.fetchErrors, m.found, m.fresh, m.forwardedBytes, m.reconnects} {
+			c.WithLabelValues(name)
+		}
+	}
+	return a
+}
+
+// Remove drops every series of an account that is no longer configured.
+func (m *Metrics) Remove(name string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.accounts, name)
+	m.mu.Unlock()
+
+	labels := prometheus.Labels{"account": name}
+	m.fetches.DeletePartialMatch(labels)
+	m.fetchErrors.DeletePartialMatch(labels)
+	m.fetchDuration.DeletePartialMatch(labels)
+	m.found.DeletePartialMatch(labels)
+	m.fresh.DeletePartialMatch(labels)
+	m.filtered.DeletePartialMatch(labels)
+	m.forwards.DeletePartialMatch(labels)
+	m.forwardedBytes.DeletePartialMatch(labels)
+	m.reconnects.DeletePartialMatch(labels)
+}
+
+// SetSharedSize sets the function that reports the number of records in the
+// cross-account dedup store.
+func (m *Metrics) SetSharedSize(fn func() int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sharedSize = fn
+}
+
+// Statuses returns the status of every account, ordered by name.
+func (m *Metrics) Statuses() []Status {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	accounts := make([]*Account, 0, len(m.accounts))
+	for _, a := range m.accounts {
+		accounts = append(accounts, a)
+	}
+	m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(accounts))
+	for _, a := range accounts {
+		statuses = append(statuses, a.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Account < statuses[j].Account })
+	return statuses
+}
+
+// Status returns a snapshot of the account's recent activity.
+func (a *Account) Status() Status {
+	a.mu.Lock()
+	storeSize := a.storeSize
+	a.mu.Unlock()
+	records := -1
+	if storeSize != nil {
+		records = storeSize()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return Status{
+		Account:                  a.name,
+		LastFetch:                a.lastFetch,
+		LastForward:              a.lastForward,
+		ConsecutiveFetchErrors:   a.fetchErrors,
+		ConsecutiveForwardErrors: a.forwardErrors,
+		AuthFailed:               a.authFailed,
+		LastError:                a.lastError,
+		LastErrorAt:              a.lastErrorAt,
+		IdleConnected:            !a.idleSince.IsZero(),
+		DedupRecords:             records,
+	}
+}
+
+// Errors returns the most recent errors of every account, newest first.
+func (m *Metrics) Errors() []ErrorEvent {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	accounts := make([]*Account, 0, len(m.accounts))
+	for _, a := range m.accounts {
+		accounts = append(accounts, a)
+	}
+	m.mu.Unlock()
+
+	var events []ErrorEvent
+	for _, a := range accounts {
+		events = append(events, a.Errors()...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.After(events[j].Time) })
+	return events
+}
+
+// Errors returns the account's most recent errors, newest first.
+func (a *Account) Errors() []ErrorEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	events := make([]ErrorEvent, len(a.errors))
+	for i, e := range a.errors {
+		events[len(events)-1-i] = e
+	}
+	return events
+}
+
+// Deliveries returns the account's most recent deliveries, newest first.
+func (a *Account) Deliveries() []Delivery {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]Delivery, len(a.deliveries))
+	for i, d := range a.deliveries {
+		out[len(out)-1-i] = d
+	}
+	return out
+}
+
+// delivered adds d to the recent deliveries. a.mu must be held.
+func (a *Account) delivered(d Delivery) {
+	if d.Time.IsZero() {
+		d.Time = time.Now()
+	}
+	if len(a.deliveries) == recentDeliveries {
+		a.deliveries = append(a.deliveries[:0], a.deliveries[1:]...)
+	}
+	a.deliveries = append(a.deliveries, d)
+}
+
+// failed records err as the account's latest error. a.mu must be held.
+func (a *Account) failed(op, msgID string, err error) {
+	now := time.Now()
+	a.lastError = err.Error()
+	a.lastErrorAt = now
+	if len(a.errors) == recentErrors {
+		a.errors = append(a.errors[:0], a.errors[1:]...)
+	}
+	a.errors = append(a.errors, ErrorEvent{
+		Time:    now,
+		Account: a.name,
+		Op:      op,
+		MsgID:   msgID,
+		Error:   err.Error(),
+	})
+}
+
+// Fetched implements receiver.Observer. Messages found but not new are
+// counted as filtered because they were seen before.
+func (a *Account) Fetched(found, fresh int, took time.Duration, err error) {
+	if a == nil {
+		return
+	}
+	a.m.fetches.WithLabelValues(a.name).Inc()
+	a.m.fetchDuration.WithLabelValues(a.name).Observe(took.Seconds())
+	a.mu.Lock()
+	if err != nil {
+		a.m.fetchErrors.WithLabelValues(a.name).Inc()
+		a.fetchErrors++
+		a.authFailed = errors.Is(err, receiver.ErrAuth)
+		a.failed("fetch", "", err)
+	} else {
+		a.lastFetch = time.Now()
+		a.fetchErrors = 0
+		a.authFailed = false
+	}
+	a.mu.Unlock()
+	a.m.found.WithLabelValues(a.name).Add(float64(found))
+	a.m.fresh.WithLabelValues(a.name).Add(float64(fresh))
+	if found > fresh {
+		a.m.filtered.WithLabelValues(a.name, "seen").Add(float64(found - fresh))
+	}
+}
+
+// Idle implements receiver.Observer.
+func (a *Account) Idle(active bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if active {
+		a.idleSince = time.Now()
+	} else {
+		a.idleSince = time.Time{}
+	}
+}
+
+// Reconnect implements receiver.Observer. A failed session counts as a
+// failed mailbox check.
+func (a *Account) Reconnect(err error) {
+	if a == nil {
+		return
+	}
+	a.m.reconnects.WithLabelValues(a.name).Inc()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fetchErrors++
+	if err != nil {
+		a.authFailed = errors.Is(err, receiver.ErrAuth)
+		a.failed("session", "", err)
+	}
+}
+
+// Filtered counts n messages that were not forwarded for reason.
+func (a *Account) Filtered(reason string, n int) {
+	if a == nil {
+		return
+	}
+	a.m.filtered.WithLabelValues(a.name, reason).Add(float64(n))
+}
+
+// Forwarded counts a message accepted by the SMTP server.
+func (a *Account) Forwarded(d Delivery) {
+	if a == nil {
+		return
+	}
+	a.m.forwards.WithLabelValues(a.name, "success", "2xx").Inc()
+	a.m.forwardedBytes.WithLabelValues(a.name).Add(float64(d.Size))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastForward = time.Now()
+	a.forwardErrors = 0
+	a.delivered(d)
+}
+
+// ForwardFailed counts a delivery that failed with err, by the class of the
+// SMTP reply.
+func (a *Account) ForwardFailed(d Delivery, err error) {
+	if a == nil {
+		return
+	}
+	a.m.forwards.WithLabelValues(a.name, "failure", sender.ReplyClass(err)).Inc()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.forwardErrors++
+	a.failed("forward", d.ID, err)
+	d.Error = err.Error()
+	a.delivered(d)
+}
+
+// DeadLettered records that delivery of a message was given up. Its failures
+// no longer count as consecutive delivery errors, so one undeliverable message
+// does not keep the account failing until the next success.
+func (a *Account) DeadLettered() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.forwardErrors = 0
+}
+
+// SetBackoff records the current wait between polls.
+func (a *Account) SetBackoff(d time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.backoff = d
+}
+
+// SetStoreSize sets the function that reports the number of records in the
+// account's dedup store. It is called on each scrape.
+func (a *Account) SetStoreSize(fn func() int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.storeSize = fn
+}
+
+var (
+	dedupRecordsDesc = prometheus.NewDesc(namespace+"_dedup_records",
+		"Records in the account's dedup store.", []string{"account"}, nil)
+	sharedRecordsDesc = prometheus.NewDesc(namespace+"_shared_dedup_records",
+		"Records in the cross-account dedup store.", nil, nil)
+	idleConnectedDesc = prometheus.NewDesc(namespace+"_idle_connected",
+		"Whether the account is waiting in IMAP IDLE.", []string{"account"}, nil)
+	idleUptimeDesc = prometheus.NewDesc(namespace+"_idle_session_uptime_seconds",
+		"Time since the current IMAP IDLE session started, or 0.", []string{"account"}, nil)
+	backoffDesc = prometheus.NewDesc(namespace+"_poll_backoff_seconds",
+		"Current wait between polls, longer than the check interval after errors.", []string{"account"}, nil)
+)
+
+// gauges reports the values that are read from each account on scrape.
+type gauges struct {
+	m *Metrics
+}
+
+func (g gauges) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dedupRecordsDesc
+	ch <- sharedRecordsDesc
+	ch <- idleConnectedDesc
+	ch <- idleUptimeDesc
+	ch <- backoffDesc
+}
+
+func (g gauges) Collect(ch chan<- prometheus.Metric) {
+	g.m.mu.Lock()
+	accounts := make([]*Account, 0, len(g.m.accounts))
+	for _, a := range g.m.accounts {
+		accounts = append(accounts, a)
+	}
+	shared := g.m.sharedSize
+	g.m.mu.Unlock()
+
+	if shared != nil {
+		if n := shared(); n >= 0 {
+			ch <- prometheus.MustNewConstMetric(sharedRecordsDesc, prometheus.GaugeValue, float64(n))
+		}
+	}
+	for _, a := range accounts {
+		a.mu.Lock()
+		idleSince, backoff, storeSize := a.idleSince, a.backoff, a.storeSize
+		a.mu.Unlock()
+
+		if storeSize != nil {
+			if n := storeSize(); n >= 0 {
+				ch <- prometheus.MustNewConstMetric(dedupRecordsDesc, prometheus.GaugeValue, float64(n), a.name)
+			}
+		}
+		connected, uptime := 0.0, 0.0
+		if !idleSince.IsZero() {
+			connected, uptime = 1, time.Since(idleSince).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(idleConnectedDesc, prometheus.GaugeValue, connected, a.name)
+		ch <- prometheus.MustNewConstMetric(idleUptimeDesc, prometheus.GaugeValue, uptime, a.name)
+		if backoff > 0 {
+			ch <- prometheus.MustNewConstMetric(backoffDesc, prometheus.GaugeValue, backoff.Seconds(), a.name)
+		}
+	}
+}
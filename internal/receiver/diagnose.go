@@ -0,0 +1,145 @@
+package receiver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-message/mail"
+	pop3client "github.com/knadh/go-pop3"
+)
+
+// testDialer connects as the receivers do, keeping the TLS state of the
+// connection for the Diagnosis.
+type testDialer struct {
+	host   string
+	useTLS bool
+	state  *tls.ConnectionState
+}
+
+func (t *testDialer) Dial(network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: testDialTimeout}
+	if !t.useTLS {
+		return d.Dial(network, addr)
+	}
+	conn, err := tls.DialWithDialer(d, network, addr, &tls.Config{ServerName: t.host})
+	if err != nil {
+		return nil, err
+	}
+	state := conn.ConnectionState()
+	t.state = &state
+	return conn, nil
+}
+
+// Test implements Tester. The folder is opened read-only, so no flags change.
+func (r *IMAPReceiver) Test(processDays int) Diagnosis {
+	addr := net.JoinHostPort(r.host, fmt.Sprintf("%d", r.port))
+	d := Diagnosis{Addr: addr, Folder: r.folder}
+
+	dialer := &testDialer{host: r.host, useTLS: r.useTLS}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		d.Err = fmt.Errorf("imap connect %s: %w", addr, err)
+		return d
+	}
+	d.Connected, d.TLS = true, dialer.state
+	client := imapclient.New(conn, &imapclient.Options{})
+	defer r.logout(client)
+	if err := client.WaitGreeting(); err != nil {
+		d.Err = fmt.Errorf("imap connect %s: %w", addr, err)
+		return d
+	}
+
+	if err := r.login(client); err != nil {
+		d.Err = err
+		return d
+	}
+	d.LoggedIn = true
+
+	// Servers often advertise more, such as IDLE, once logged in.
+	caps, err := client.Capability().Wait()
+	if err != nil {
+		d.Err = fmt.Errorf("imap capability: %w", err)
+		return d
+	}
+	for c := range caps {
+		d.Capabilities = append(d.Capabilities, string(c))
+	}
+	slices.Sort(d.Capabilities)
+
+	sel, err := client.Select(r.folder, &imap.SelectOptions{ReadOnly: true}).Wait()
+	if err != nil {
+		d.Err = fmt.Errorf("imap select %s: %w", r.folder, err)
+		return d
+	}
+	d.Messages = int(sel.NumMessages)
+
+	since := time.Now().AddDate(0, 0, -processDays)
+	searchData, err := client.UIDSearch(&imap.SearchCriteria{Since: since}, nil).Wait()
+	if err != nil {
+		d.Err = fmt.Errorf("imap search: %w", err)
+		return d
+	}
+	d.InWindow = len(searchData.AllUIDs())
+	return d
+}
+
+// Test implements Tester. Messages in the window are counted from their
+// headers, read with TOP, so each message costs one round trip.
+func (r *POP3Receiver) Test(processDays int) Diagnosis {
+	addr := net.JoinHostPort(r.host, fmt.Sprintf("%d", r.port))
+	d := Diagnosis{Addr: addr}
+
+	// The dialer sets up TLS itself, to keep its state.
+	dialer := &testDialer{host: r.host, useTLS: r.useTLS}
+	client := pop3client.New(pop3client.Opt{Host: r.host, Port: r.port, Dialer: dialer})
+	conn, err := client.NewConn()
+	if err != nil {
+		d.Err = fmt.Errorf("pop3 connect %s: %w", addr, err)
+		return d
+	}
+	defer conn.Quit()
+	d.Connected, d.TLS = true, dialer.state
+
+	// CAPA is optional (RFC 2449); a server without it lists nothing.
+	if buf, err := conn.Cmd("CAPA", true); err == nil {
+		for line := range strings.Lines(buf.String()) {
+			if line = strings.TrimSpace(line); line != "" {
+				d.Capabilities = append(d.Capabilities, line)
+			}
+		}
+	}
+
+	if err := conn.Auth(r.username, r.password); err != nil {
+		d.Err = pop3AuthError(r.username, err)
+		return d
+	}
+	d.LoggedIn = true
+
+	msgs, err := conn.List(0)
+	if err != nil {
+		d.Err = fmt.Errorf("pop3 list: %w", err)
+		return d
+	}
+	d.Messages = len(msgs)
+
+	// As in Fetch, a message without a usable date counts as recent.
+	cutoff := time.Now().AddDate(0, 0, -processDays)
+	for _, msg := range msgs {
+		top, err := conn.Top(msg.ID, 0)
+		if err != nil {
+			d.Err = fmt.Errorf("pop3 top %d: %w", msg.ID, err)
+			return d
+		}
+		date, err := (&mail.Header{Header: top.Header}).Date()
+		if err != nil || date.IsZero() || !date.Before(cutoff) {
+			d.InWindow++
+		}
+	}
+	return d
+}
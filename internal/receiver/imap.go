@@ -3,18 +3,26 @@ package receiver
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tracyhatemice/gomailify/internal/tracing"
 )
 
 const (
 	imapInitialBackoff = 30 * time.Minute
 	imapMaxBackoff     = 60 * time.Minute
+	imapListBatch      = 1000 // UIDs per envelope fetch in ListIDs
+	imapHashBatch      = 50   // UIDs per full-message fetch in ListIDs when hashing
 )
 
 // IMAPReceiver fetches emails over IMAP/IMAPS and implements Watcher via IDLE.
@@ -28,14 +36,19 @@ type IMAPReceiver struct {
 	folder       string
 	pollInterval time.Duration // fallback interval when IDLE is unsupported
 	useIdle      bool          // if false, polling is used even when server supports IDLE
+	dedupKey     string        // one of the Key* strategies
+	observer     Observer
 	logger       *slog.Logger
 }
 
 // NewIMAP creates a new IMAP receiver.
-func NewIMAP(name, host string, port int, username, password string, useTLS bool, folder string, pollInterval time.Duration, useIdle bool, logger *slog.Logger) *IMAPReceiver {
+func NewIMAP(name, host string, port int, username, password string, useTLS bool, folder string, pollInterval time.Duration, useIdle bool, dedupKey string, logger *slog.Logger) *IMAPReceiver {
 	if folder == "" {
 		folder = "INBOX"
 	}
+	if dedupKey == "" {
+		dedupKey = KeyMessageID
+	}
 	return &IMAPReceiver{
 		name:         name,
 		host:         host,
@@ -46,34 +59,61 @@ func NewIMAP(name, host string, port int, username, password string, useTLS bool
 		folder:       folder,
 		pollInterval: pollInterval,
 		useIdle:      useIdle,
+		dedupKey:     dedupKey,
+		observer:     nopObserver{},
 		logger:       logger,
 	}
 }
 
+// Observe implements Observable.
+func (r *IMAPReceiver) Observe(obs Observer) {
+	if obs == nil {
+		obs = nopObserver{}
+	}
+	r.observer = obs
+}
+
 // Fetch opens a one-shot connection, retrieves new emails, and closes.
-func (r *IMAPReceiver) Fetch(seenIDs map[string]struct{}, processDays int) ([]Email, error) {
+func (r *IMAPReceiver) Fetch(ctx context.Context, seen func(id string) bool, processDays int) (emails []Email, err error) {
+	start := time.Now()
+	found := 0
+	ctx, span := tracer.Start(ctx, "imap.fetch", trace.WithAttributes(
+		attribute.String("account", r.name),
+		attribute.String("folder", r.folder),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("found", found), attribute.Int("new", len(emails)))
+		tracing.End(span, err)
+		r.observer.Fetched(found, len(emails), time.Since(start), err)
+	}()
+
+	_, connSpan := tracer.Start(ctx, "imap.connect")
 	client, err := r.dial(nil)
+	tracing.End(connSpan, err)
 	if err != nil {
 		return nil, err
 	}
 	defer r.logout(client)
 
-	if _, err := client.Select(r.folder, nil).Wait(); err != nil {
+	sel, err := client.Select(r.folder, nil).Wait()
+	if err != nil {
 		return nil, fmt.Errorf("imap select %s: %w", r.folder, err)
 	}
 
-	return r.fetchMessages(client, seenIDs, processDays)
+	emails, found, err = r.fetchMessages(ctx, client, sel.UIDValidity, seen, processDays)
+	return emails, err
 }
 
 // Watch maintains a persistent connection, using IMAP IDLE when the server
 // supports it (advertised in capabilities) and falling back to timed polling
 // on the same connection otherwise. Reconnects with exponential backoff.
-func (r *IMAPReceiver) Watch(ctx context.Context, getSeenIDs func() map[string]struct{}, processDays int, onNew func([]Email)) {
+func (r *IMAPReceiver) Watch(ctx context.Context, seen func(id string) bool, processDays int, onNew func(context.Context, []Email)) {
 	backoff := imapInitialBackoff
 	for {
-		if err := r.runSession(ctx, getSeenIDs, processDays, onNew); ctx.Err() != nil {
+		if err := r.runSession(ctx, seen, processDays, onNew); ctx.Err() != nil {
 			return
 		} else {
+			r.observer.Reconnect(err)
 			r.logger.Error("imap session ended, reconnecting",
 				"account", r.name,
 				"error", err,
@@ -91,7 +131,7 @@ func (r *IMAPReceiver) Watch(ctx context.Context, getSeenIDs func() map[string]s
 
 // runSession connects, selects the folder, performs an initial fetch, then
 // dispatches to idleLoop or pollLoop based on server capabilities.
-func (r *IMAPReceiver) runSession(ctx context.Context, getSeenIDs func() map[string]struct{}, processDays int, onNew func([]Email)) error {
+func (r *IMAPReceiver) runSession(ctx context.Context, seen func(id string) bool, processDays int, onNew func(context.Context, []Email)) error {
 	notify := make(chan struct{}, 1)
 
 	client, err := r.dial(&imapclient.UnilateralDataHandler{
@@ -119,26 +159,29 @@ func (r *IMAPReceiver) runSession(ctx context.Context, getSeenIDs func() map[str
 		r.logger.Info("using polling (IDLE disabled)", "account", r.name, "interval", r.pollInterval)
 	}
 
-	if _, err := client.Select(r.folder, nil).Wait(); err != nil {
+	sel, err := client.Select(r.folder, nil).Wait()
+	if err != nil {
 		return fmt.Errorf("imap select %s: %w", r.folder, err)
 	}
 
 	// Initial fetch on connect.
-	r.deliverNew(client, getSeenIDs(), processDays, onNew)
+	r.deliverNew(ctx, client, sel.UIDValidity, seen, processDays, onNew)
 
 	if idleEnabled {
-		return r.idleLoop(ctx, client, notify, getSeenIDs, processDays, onNew)
+		return r.idleLoop(ctx, client, sel.UIDValidity, notify, seen, processDays, onNew)
 	}
-	r.pollLoop(ctx, getSeenIDs, processDays, onNew)
+	r.pollLoop(ctx, seen, processDays, onNew)
 	return nil
 }
 
 // idleLoop blocks in IDLE, waking on server notifications to fetch new mail.
-func (r *IMAPReceiver) idleLoop(ctx context.Context, client *imapclient.Client, notify <-chan struct{}, getSeenIDs func() map[string]struct{}, processDays int, onNew func([]Email)) error {
+func (r *IMAPReceiver) idleLoop(ctx context.Context, client *imapclient.Client, uidValidity uint32, notify <-chan struct{}, seen func(id string) bool, processDays int, onNew func(context.Context, []Email)) error {
 	idleCmd, err := client.Idle()
 	if err != nil {
 		return fmt.Errorf("imap idle: %w", err)
 	}
+	r.observer.Idle(true)
+	defer r.observer.Idle(false)
 
 	for {
 		idleDone := make(chan error, 1)
@@ -160,7 +203,7 @@ func (r *IMAPReceiver) idleLoop(ctx context.Context, client *imapclient.Client,
 			if err := <-idleDone; err != nil {
 				return fmt.Errorf("imap idle wait: %w", err)
 			}
-			r.deliverNew(client, getSeenIDs(), processDays, onNew)
+			r.deliverNew(ctx, client, uidValidity, seen, processDays, onNew)
 
 			if idleCmd, err = client.Idle(); err != nil {
 				return fmt.Errorf("imap idle restart: %w", err)
@@ -172,7 +215,7 @@ func (r *IMAPReceiver) idleLoop(ctx context.Context, client *imapclient.Client,
 // pollLoop polls on r.pollInterval, opening a fresh connection for each tick.
 // A fresh connection per tick avoids server-side idle-timeout errors that occur
 // when a persistent connection sits unused for the full poll interval.
-func (r *IMAPReceiver) pollLoop(ctx context.Context, getSeenIDs func() map[string]struct{}, processDays int, onNew func([]Email)) {
+func (r *IMAPReceiver) pollLoop(ctx context.Context, seen func(id string) bool, processDays int, onNew func(context.Context, []Email)) {
 	ticker := time.NewTicker(r.pollInterval)
 	defer ticker.Stop()
 	for {
@@ -180,42 +223,56 @@ func (r *IMAPReceiver) pollLoop(ctx context.Context, getSeenIDs func() map[strin
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			emails, err := r.Fetch(getSeenIDs(), processDays)
+			emails, err := r.Fetch(ctx, seen, processDays)
 			if err != nil {
 				r.logger.Error("imap fetch failed", "account", r.name, "error", err)
 				continue
 			}
 			if len(emails) > 0 {
-				onNew(emails)
+				onNew(ctx, emails)
 			}
 		}
 	}
 }
 
-func (r *IMAPReceiver) deliverNew(client *imapclient.Client, seenIDs map[string]struct{}, processDays int, onNew func([]Email)) {
-	emails, err := r.fetchMessages(client, seenIDs, processDays)
+func (r *IMAPReceiver) deliverNew(ctx context.Context, client *imapclient.Client, uidValidity uint32, seen func(id string) bool, processDays int, onNew func(context.Context, []Email)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "imap.fetch", trace.WithAttributes(
+		attribute.String("account", r.name),
+		attribute.String("folder", r.folder),
+		attribute.Bool("idle", true),
+	))
+	emails, found, err := r.fetchMessages(ctx, client, uidValidity, seen, processDays)
+	span.SetAttributes(attribute.Int("found", found), attribute.Int("new", len(emails)))
+	r.observer.Fetched(found, len(emails), time.Since(start), err)
+	// The span stays open while onNew forwards the emails, so their spans
+	// belong to this trace.
+	defer tracing.End(span, err)
 	if err != nil {
 		r.logger.Error("imap fetch failed", "account", r.name, "error", err)
 		return
 	}
 	if len(emails) > 0 {
-		onNew(emails)
+		onNew(ctx, emails)
 	}
 }
 
 // fetchMessages searches for and retrieves new emails on an already-selected client.
-// It uses UID-based search and fetch for stable message identification.
-func (r *IMAPReceiver) fetchMessages(client *imapclient.Client, seenIDs map[string]struct{}, processDays int) ([]Email, error) {
+// It uses UID-based search and fetch for stable message identification, and
+// also returns the number of messages in the date range.
+func (r *IMAPReceiver) fetchMessages(ctx context.Context, client *imapclient.Client, uidValidity uint32, seen func(id string) bool, processDays int) ([]Email, int, error) {
 	since := time.Now().AddDate(0, 0, -processDays)
+	_, searchSpan := tracer.Start(ctx, "imap.search")
 	searchData, err := client.UIDSearch(&imap.SearchCriteria{Since: since}, nil).Wait()
+	tracing.End(searchSpan, err)
 	if err != nil {
-		return nil, fmt.Errorf("imap search: %w", err)
+		return nil, 0, fmt.Errorf("imap search: %w", err)
 	}
 
 	uids := searchData.AllUIDs()
 	if len(uids) == 0 {
 		r.logger.Debug("no messages found in date range", "account", r.name)
-		return nil, nil
+		return nil, 0, nil
 	}
 	r.logger.Info("found messages in date range", "account", r.name, "count", len(uids))
 
@@ -224,40 +281,174 @@ func (r *IMAPReceiver) fetchMessages(client *imapclient.Client, seenIDs map[stri
 		Envelope:    true,
 		BodySection: []*imap.FetchItemBodySection{{Peek: true}},
 	}
-	msgs, err := client.Fetch(imap.UIDSetNum(uids...), fetchOpts).Collect()
+	msgs, err := r.collect(ctx, client.Fetch(imap.UIDSetNum(uids...), fetchOpts))
 	if err != nil {
-		return nil, fmt.Errorf("imap fetch: %w", err)
+		return nil, len(uids), fmt.Errorf("imap fetch: %w", err)
 	}
 
 	bodySection := &imap.FetchItemBodySection{Peek: true}
 	var emails []Email
 	for _, msg := range msgs {
-		msgID := ""
-		if msg.Envelope != nil {
-			msgID = msg.Envelope.MessageID
-		}
-		if msgID == "" {
-			msgID = fmt.Sprintf("imap-uid-%d-%s", msg.UID, r.username)
-		}
-		if _, seen := seenIDs[msgID]; seen {
+		content := msg.FindBodySection(bodySection)
+		msgID := r.key(msg, uidValidity, content)
+		if seen(msgID) {
 			continue
 		}
 
-		content := msg.FindBodySection(bodySection)
 		if len(content) == 0 {
 			r.logger.Warn("empty body, skipping", "account", r.name, "msg_id", msgID)
 			continue
 		}
 
 		var date time.Time
+		var header string
 		if msg.Envelope != nil {
 			date = msg.Envelope.Date
+			header = msg.Envelope.MessageID
 		}
-		emails = append(emails, Email{ID: msgID, Date: date, Content: content})
+		emails = append(emails, Email{ID: msgID, MessageID: header, Date: date, Content: content})
 	}
 
 	r.logger.Info("filtered emails", "account", r.name, "new", len(emails))
-	return emails, nil
+	return emails, len(uids), nil
+}
+
+// collect reads the messages returned by cmd, tracing the download of each
+// one in its own span.
+func (r *IMAPReceiver) collect(ctx context.Context, cmd *imapclient.FetchCommand) ([]*imapclient.FetchMessageBuffer, error) {
+	bodySection := &imap.FetchItemBodySection{Peek: true}
+	var msgs []*imapclient.FetchMessageBuffer
+	for data := cmd.Next(); data != nil; data = cmd.Next() {
+		_, span := tracer.Start(ctx, "imap.fetch_message")
+		msg, err := data.Collect()
+		if err == nil {
+			span.SetAttributes(
+				attribute.Int64("uid", int64(msg.UID)),
+				attribute.Int("size", len(msg.FindBodySection(bodySection))),
+			)
+			if msg.Envelope != nil {
+				span.SetAttributes(attribute.String("message_id", msg.Envelope.MessageID))
+			}
+			msgs = append(msgs, msg)
+		}
+		tracing.End(span, err)
+		if err != nil {
+			cmd.Close()
+			return nil, err
+		}
+	}
+	if err := cmd.Close(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// ListIDs returns the ID of every message in the folder, fetching only UIDs
+// and envelopes unless the content_hash key needs the full message.
+func (r *IMAPReceiver) ListIDs() ([]string, error) {
+	client, err := r.dial(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.logout(client)
+
+	sel, err := client.Select(r.folder, nil).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("imap select %s: %w", r.folder, err)
+	}
+
+	searchData, err := client.UIDSearch(&imap.SearchCriteria{}, nil).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("imap search: %w", err)
+	}
+	uids := searchData.AllUIDs()
+	r.logger.Info("listing message IDs", "account", r.name, "count", len(uids))
+
+	ids := make([]string, 0, len(uids))
+	fetchOpts := &imap.FetchOptions{UID: true, Envelope: true}
+	batchSize := imapListBatch
+	bodySection := &imap.FetchItemBodySection{Peek: true}
+	if r.dedupKey == KeyContentHash {
+		fetchOpts.BodySection = []*imap.FetchItemBodySection{bodySection}
+		batchSize = imapHashBatch
+	}
+	for start := 0; start < len(uids); start += batchSize {
+		batch := uids[start:min(start+batchSize, len(uids))]
+		msgs, err := client.Fetch(imap.UIDSetNum(batch...), fetchOpts).Collect()
+		if err != nil {
+			return nil, fmt.Errorf("imap fetch envelopes: %w", err)
+		}
+		for _, msg := range msgs {
+			ids = append(ids, r.key(msg, sel.UIDValidity, msg.FindBodySection(bodySection)))
+		}
+	}
+	return ids, nil
+}
+
+// Find implements Finder. It searches the whole folder on a one-shot
+// connection.
+func (r *IMAPReceiver) Find(messageID string) (Email, bool, error) {
+	client, err := r.dial(nil)
+	if err != nil {
+		return Email{}, false, err
+	}
+	defer r.logout(client)
+
+	sel, err := client.Select(r.folder, nil).Wait()
+	if err != nil {
+		return Email{}, false, fmt.Errorf("imap select %s: %w", r.folder, err)
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(messageID), "<"), ">")
+	criteria := &imap.SearchCriteria{
+		Header: []imap.SearchCriteriaHeaderField{{Key: "Message-ID", Value: id}},
+	}
+	searchData, err := client.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		return Email{}, false, fmt.Errorf("imap search: %w", err)
+	}
+	uids := searchData.AllUIDs()
+	if len(uids) == 0 {
+		return Email{}, false, nil
+	}
+
+	bodySection := &imap.FetchItemBodySection{Peek: true}
+	msgs, err := client.Fetch(imap.UIDSetNum(uids...), &imap.FetchOptions{
+		UID:         true,
+		Envelope:    true,
+		BodySection: []*imap.FetchItemBodySection{bodySection},
+	}).Collect()
+	if err != nil {
+		return Email{}, false, fmt.Errorf("imap fetch: %w", err)
+	}
+	// HEADER search matches substrings, so confirm the match.
+	for _, msg := range msgs {
+		if msg.Envelope == nil || !sameMessageID(msg.Envelope.MessageID, messageID) {
+			continue
+		}
+		content := msg.FindBodySection(bodySection)
+		return Email{
+			ID:        r.key(msg, sel.UIDValidity, content),
+			MessageID: msg.Envelope.MessageID,
+			Date:      msg.Envelope.Date,
+			Content:   content,
+		}, true, nil
+	}
+	return Email{}, false, nil
+}
+
+// key returns the dedup ID of msg under r.dedupKey. content is the full
+// message and is only consulted for content hashing.
+func (r *IMAPReceiver) key(msg *imapclient.FetchMessageBuffer, uidValidity uint32, content []byte) string {
+	switch r.dedupKey {
+	case KeyContentHash:
+		return contentHash(content)
+	case KeyUID:
+		return fmt.Sprintf("imap-uid-%d-%d-%s", uidValidity, msg.UID, r.username)
+	}
+	if msg.Envelope != nil && msg.Envelope.MessageID != "" {
+		return msg.Envelope.MessageID
+	}
+	return fmt.Sprintf("imap-uid-%d-%s", msg.UID, r.username)
 }
 
 // dial creates an authenticated IMAP connection.
@@ -281,13 +472,26 @@ func (r *IMAPReceiver) dial(handler *imapclient.UnilateralDataHandler) (*imapcli
 	if err != nil {
 		return nil, fmt.Errorf("imap connect %s: %w", addr, err)
 	}
-	if err := client.Login(r.username, r.password).Wait(); err != nil {
+	if err := r.login(client); err != nil {
 		client.Close()
-		return nil, fmt.Errorf("imap login %s: %w", r.username, err)
+		return nil, err
 	}
 	return client, nil
 }
 
+// login authenticates client. A NO reply, as opposed to a broken connection,
+// means the server rejected the credentials and is marked with ErrAuth.
+func (r *IMAPReceiver) login(client *imapclient.Client) error {
+	if err := client.Login(r.username, r.password).Wait(); err != nil {
+		var imapErr *imap.Error
+		if errors.As(err, &imapErr) && imapErr.Type == imap.StatusResponseTypeNo {
+			return fmt.Errorf("imap login %s: %w: %w", r.username, ErrAuth, err)
+		}
+		return fmt.Errorf("imap login %s: %w", r.username, err)
+	}
+	return nil
+}
+
 // logout cleanly signs off and closes the connection.
 func (r *IMAPReceiver) logout(client *imapclient.Client) {
 	if err := client.Logout().Wait(); err != nil {
@@ -0,0 +1,72 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Dedup key strategies, selecting how Email.ID is derived.
+const (
+	// KeyMessageID uses the Message-ID header, falling back to the server
+	// UID and then the content hash when it is missing.
+	KeyMessageID = "message_id"
+
+	// KeyUID uses the server's identifier (IMAP UIDVALIDITY+UID, POP3
+	// UIDL), falling back to the content hash when the server has none.
+	KeyUID = "uid"
+
+	// KeyContentHash uses a digest of selected headers and the body, so
+	// distinct messages sharing a Message-ID are told apart while copies
+	// of the same message with different trace headers are not.
+	KeyContentHash = "content_hash"
+)
+
+// hashedHeaders are the headers that identify a message's content. Trace
+// headers added in transit (Received, Return-Path, Delivered-To, DKIM and
+// ARC signatures, spam scores, ...) are deliberately excluded.
+var hashedHeaders = []string{"From", "To", "Cc", "Subject", "Date", "Message-Id", "In-Reply-To"}
+
+// contentHash returns a stable key for raw: a SHA-256 over the normalized
+// values of hashedHeaders followed by a SHA-256 of the normalized body.
+func contentHash(raw []byte) string {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		sum := sha256.Sum256(raw)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	h := sha256.New()
+	for _, key := range hashedHeaders {
+		io.WriteString(h, strings.ToLower(key))
+		h.Write([]byte{':'})
+		for _, v := range header.Values(key) {
+			io.WriteString(h, strings.Join(strings.Fields(v), " "))
+			h.Write([]byte{'\n'})
+		}
+	}
+
+	body, _ := io.ReadAll(br)
+	bodySum := sha256.Sum256(normalizeBody(body))
+	h.Write(bodySum[:])
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeBody canonicalizes line endings and strips trailing whitespace on
+// each line and trailing blank lines, which relays are known to alter.
+func normalizeBody(body []byte) []byte {
+	lines := bytes.Split(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
@@ -2,13 +2,21 @@ package receiver
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/mail"
 	pop3client "github.com/knadh/go-pop3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tracyhatemice/gomailify/internal/tracing"
 )
 
 // POP3Receiver fetches emails over POP3/POP3S.
@@ -19,14 +27,23 @@ type POP3Receiver struct {
 	username string
 	password string
 	useTLS   bool
+	dedupKey string // one of the Key* strategies
+	observer Observer
 	logger   *slog.Logger
 
-	knownUIDs     map[string]struct{} // cached server UIDs from last poll
-	uidlSupported *bool               // nil=untested, then true/false
+	knownUIDs     map[string]string // UID → ID of messages the last poll skipped for good
+	uidlSupported *bool             // nil=untested, then true/false
+
+	mu        sync.Mutex
+	onServer  map[string]struct{} // IDs in the mailbox at the last successful Fetch
+	forgotten map[string]struct{} // IDs to drop from knownUIDs at the next Fetch
 }
 
 // NewPOP3 creates a new POP3 receiver.
-func NewPOP3(name, host string, port int, username, password string, useTLS bool, logger *slog.Logger) *POP3Receiver {
+func NewPOP3(name, host string, port int, username, password string, useTLS bool, dedupKey string, logger *slog.Logger) *POP3Receiver {
+	if dedupKey == "" {
+		dedupKey = KeyMessageID
+	}
 	return &POP3Receiver{
 		name:      name,
 		host:      host,
@@ -34,12 +51,31 @@ func NewPOP3(name, host string, port int, username, password string, useTLS bool
 		username:  username,
 		password:  password,
 		useTLS:    useTLS,
+		dedupKey:  dedupKey,
+		observer:  nopObserver{},
 		logger:    logger,
-		knownUIDs: make(map[string]struct{}),
+		knownUIDs: make(map[string]string),
+	}
+}
+
+// Observe implements Observable.
+func (r *POP3Receiver) Observe(obs Observer) {
+	if obs == nil {
+		obs = nopObserver{}
 	}
+	r.observer = obs
 }
 
-func (r *POP3Receiver) Fetch(seenIDs map[string]struct{}, processDays int) ([]Email, error) {
+func (r *POP3Receiver) Fetch(ctx context.Context, seen func(id string) bool, processDays int) (emails []Email, err error) {
+	start := time.Now()
+	found := 0
+	ctx, span := tracer.Start(ctx, "pop3.fetch", trace.WithAttributes(attribute.String("account", r.name)))
+	defer func() {
+		span.SetAttributes(attribute.Int("found", found), attribute.Int("new", len(emails)))
+		tracing.End(span, err)
+		r.observer.Fetched(found, len(emails), time.Since(start), err)
+	}()
+
 	addr := net.JoinHostPort(r.host, fmt.Sprintf("%d", r.port))
 
 	opt := pop3client.Opt{
@@ -48,88 +84,267 @@ func (r *POP3Receiver) Fetch(seenIDs map[string]struct{}, processDays int) ([]Em
 		TLSEnabled: r.useTLS,
 	}
 
+	_, connSpan := tracer.Start(ctx, "pop3.connect")
 	client := pop3client.New(opt)
 	conn, err := client.NewConn()
 	if err != nil {
+		tracing.End(connSpan, err)
 		return nil, fmt.Errorf("pop3 connect %s: %w", addr, err)
 	}
 	defer conn.Quit()
 
-	if err := conn.Auth(r.username, r.password); err != nil {
-		return nil, fmt.Errorf("pop3 auth %s: %w", r.username, err)
+	err = conn.Auth(r.username, r.password)
+	tracing.End(connSpan, err)
+	if err != nil {
+		return nil, pop3AuthError(r.username, err)
 	}
 
+	_, listSpan := tracer.Start(ctx, "pop3.list")
 	msgs, err := conn.List(0)
+	tracing.End(listSpan, err)
 	if err != nil {
 		return nil, fmt.Errorf("pop3 list: %w", err)
 	}
 
+	found = len(msgs)
 	r.logger.Info("fetched message list", "account", r.name, "count", len(msgs))
 
 	// Try UIDL to detect new messages without downloading.
 	uidMap := r.fetchUIDs(conn)
 
+	r.mu.Lock()
+	for uid, id := range r.knownUIDs {
+		if _, ok := r.forgotten[id]; ok {
+			delete(r.knownUIDs, uid)
+		}
+	}
+	r.forgotten = nil
+	r.mu.Unlock()
+
 	cutoff := time.Now().AddDate(0, 0, -processDays)
-	var emails []Email
 	var skipped int
 
+	// Only messages skipped for good are remembered. Those returned are
+	// downloaded again next time, so a failed delivery can be retried.
+	newKnown := make(map[string]string, len(uidMap))
+	onServer := make(map[string]struct{}, len(msgs))
+	complete := true
 	for _, msg := range msgs {
 		uid := uidMap[msg.ID]
 
 		// If UIDL available and UID already known, skip download.
 		if uid != "" {
-			if _, known := r.knownUIDs[uid]; known {
+			if id, known := r.knownUIDs[uid]; known {
+				newKnown[uid] = id
+				onServer[id] = struct{}{}
 				skipped++
 				continue
 			}
 		}
 
+		_, retrSpan := tracer.Start(ctx, "pop3.retr", trace.WithAttributes(attribute.Int("msg_num", msg.ID)))
 		rawBuf, err := conn.RetrRaw(msg.ID)
 		if err != nil {
+			tracing.End(retrSpan, err)
 			r.logger.Warn("pop3 retrieve failed", "msg_id", msg.ID, "error", err)
+			complete = false
 			continue
 		}
 		raw := rawBuf.Bytes()
 
-		msgID := extractMessageID(raw)
-		if msgID == "" {
+		header := extractMessageID(raw)
+		retrSpan.SetAttributes(attribute.String("message_id", header), attribute.Int("size", len(raw)))
+		retrSpan.End()
+		msgID := r.key(header, uid, raw)
+		onServer[msgID] = struct{}{}
+
+		if seen(msgID) {
 			if uid != "" {
-				msgID = fmt.Sprintf("pop3-uid-%s-%s", uid, r.username)
-			} else {
-				msgID = fmt.Sprintf("pop3-%d-%s", msg.ID, r.username)
+				newKnown[uid] = msgID
 			}
-		}
-
-		if _, seen := seenIDs[msgID]; seen {
 			continue
 		}
 
 		date := extractDate(raw)
 		if !date.IsZero() && date.Before(cutoff) {
+			if uid != "" {
+				newKnown[uid] = msgID
+			}
 			continue
 		}
 
 		emails = append(emails, Email{
-			ID:      msgID,
-			Date:    date,
-			Content: raw,
+			ID:        msgID,
+			MessageID: header,
+			Date:      date,
+			Content:   raw,
 		})
 	}
 
-	// Update knownUIDs to current server snapshot.
-	if len(uidMap) > 0 {
-		newKnown := make(map[string]struct{}, len(uidMap))
-		for _, uid := range uidMap {
-			newKnown[uid] = struct{}{}
-		}
-		r.knownUIDs = newKnown
+	r.knownUIDs = newKnown
+	if !complete {
+		// The IDs of messages that could not be downloaded are unknown.
+		onServer = nil
 	}
+	r.mu.Lock()
+	r.onServer = onServer
+	r.mu.Unlock()
 
 	r.logger.Info("filtered emails", "account", r.name,
 		"new", len(emails), "uidl_skipped", skipped)
 	return emails, nil
 }
 
+// OnServer implements Retainer.
+func (r *POP3Receiver) OnServer() map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.onServer
+}
+
+// Forget implements Forgetter. It takes effect at the next Fetch, so it is
+// safe to call while one is running.
+func (r *POP3Receiver) Forget(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.forgotten == nil {
+		r.forgotten = make(map[string]struct{})
+	}
+	r.forgotten[id] = struct{}{}
+}
+
+// ListIDs returns the ID of every message in the mailbox. It reads only the
+// headers of each message via TOP, unless the ID has to be derived from the
+// content, in which case the message is downloaded.
+func (r *POP3Receiver) ListIDs() ([]string, error) {
+	conn, err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Quit()
+
+	msgs, err := conn.List(0)
+	if err != nil {
+		return nil, fmt.Errorf("pop3 list: %w", err)
+	}
+	r.logger.Info("listing message IDs", "account", r.name, "count", len(msgs))
+
+	uidMap := r.fetchUIDs(conn)
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		uid := uidMap[msg.ID]
+		var header string
+		if r.dedupKey == KeyMessageID {
+			top, err := conn.Top(msg.ID, 0)
+			if err != nil {
+				return nil, fmt.Errorf("pop3 top %d: %w", msg.ID, err)
+			}
+			header = top.Header.Get("Message-ID")
+		}
+		if r.needsContent(header, uid) {
+			raw, err := conn.RetrRaw(msg.ID)
+			if err != nil {
+				return nil, fmt.Errorf("pop3 retrieve %d: %w", msg.ID, err)
+			}
+			ids = append(ids, r.key(header, uid, raw.Bytes()))
+			continue
+		}
+		ids = append(ids, r.key(header, uid, nil))
+	}
+	return ids, nil
+}
+
+// Find implements Finder. It reads the headers of each message via TOP and
+// downloads only the one that matches.
+func (r *POP3Receiver) Find(messageID string) (Email, bool, error) {
+	conn, err := r.connect()
+	if err != nil {
+		return Email{}, false, err
+	}
+	defer conn.Quit()
+
+	msgs, err := conn.List(0)
+	if err != nil {
+		return Email{}, false, fmt.Errorf("pop3 list: %w", err)
+	}
+	uidMap := r.fetchUIDs(conn)
+	for _, msg := range msgs {
+		top, err := conn.Top(msg.ID, 0)
+		if err != nil {
+			return Email{}, false, fmt.Errorf("pop3 top %d: %w", msg.ID, err)
+		}
+		header := top.Header.Get("Message-ID")
+		if !sameMessageID(header, messageID) {
+			continue
+		}
+		raw, err := conn.RetrRaw(msg.ID)
+		if err != nil {
+			return Email{}, false, fmt.Errorf("pop3 retrieve %d: %w", msg.ID, err)
+		}
+		return Email{
+			ID:        r.key(header, uidMap[msg.ID], raw.Bytes()),
+			MessageID: header,
+			Date:      extractDate(raw.Bytes()),
+			Content:   raw.Bytes(),
+		}, true, nil
+	}
+	return Email{}, false, nil
+}
+
+// connect opens an authenticated connection for a one-shot operation.
+func (r *POP3Receiver) connect() (*pop3client.Conn, error) {
+	client := pop3client.New(pop3client.Opt{
+		Host:       r.host,
+		Port:       r.port,
+		TLSEnabled: r.useTLS,
+	})
+	conn, err := client.NewConn()
+	if err != nil {
+		return nil, fmt.Errorf("pop3 connect %s: %w", net.JoinHostPort(r.host, fmt.Sprintf("%d", r.port)), err)
+	}
+	if err := conn.Auth(r.username, r.password); err != nil {
+		conn.Quit()
+		return nil, pop3AuthError(r.username, err)
+	}
+	return conn, nil
+}
+
+// pop3AuthError describes a failed login as user. A -ERR reply, as opposed to
+// a broken connection, means the server rejected the credentials and is
+// marked with ErrAuth.
+func pop3AuthError(user string, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("pop3 auth %s: %w", user, err)
+	}
+	return fmt.Errorf("pop3 auth %s: %w: %w", user, ErrAuth, err)
+}
+
+// key returns the dedup ID for a message under r.dedupKey, given its
+// Message-ID header and UIDL unique ID (either may be empty). Without a usable
+// header or UID it falls back to the content hash: sequence numbers shift as
+// messages are deleted and must never be used as identity.
+func (r *POP3Receiver) key(header, uid string, raw []byte) string {
+	if r.needsContent(header, uid) {
+		return contentHash(raw)
+	}
+	if r.dedupKey == KeyMessageID && header != "" {
+		return header
+	}
+	return fmt.Sprintf("pop3-uid-%s-%s", uid, r.username)
+}
+
+// needsContent reports whether key needs the raw message to derive the ID.
+func (r *POP3Receiver) needsContent(header, uid string) bool {
+	switch r.dedupKey {
+	case KeyContentHash:
+		return true
+	case KeyUID:
+		return uid == ""
+	}
+	return header == "" && uid == ""
+}
+
 func (r *POP3Receiver) Close() error {
 	return nil
 }
@@ -2,21 +2,43 @@ package receiver
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("github.com/tracyhatemice/gomailify/internal/receiver")
+
+// ErrAuth marks errors caused by the server rejecting the account's
+// credentials, as opposed to network or protocol failures.
+var ErrAuth = errors.New("authentication failed")
+
 // Email represents a fetched email message.
 type Email struct {
-	ID      string    // unique identifier (Message-ID or UID)
-	Date    time.Time // date the email was sent/received
-	Content []byte    // raw RFC 5322 message bytes
+	ID        string    // dedup key, derived per the account's dedup_key strategy
+	MessageID string    // Message-ID header, empty if the message has none
+	Date      time.Time // date the email was sent/received
+	Content   []byte    // raw RFC 5322 message bytes
+}
+
+// OriginalID returns the identifier to report as the original message: the
+// Message-ID header if present, otherwise the dedup key.
+func (e Email) OriginalID() string {
+	if e.MessageID != "" {
+		return e.MessageID
+	}
+	return e.ID
 }
 
 // Receiver fetches emails from a remote mail server.
 type Receiver interface {
 	// Fetch returns emails from approximately the last processDays days.
-	// It should skip IDs present in seenIDs.
-	Fetch(seenIDs map[string]struct{}, processDays int) ([]Email, error)
+	// It should skip IDs for which seen returns true. ctx carries the trace
+	// the fetch belongs to.
+	Fetch(ctx context.Context, seen func(id string) bool, processDays int) ([]Email, error)
 
 	// Close releases any resources held by the receiver.
 	Close() error
@@ -27,7 +49,112 @@ type Receiver interface {
 // avoiding repeated logins.
 type Watcher interface {
 	// Watch maintains a persistent connection and calls onNew whenever new
-	// emails are available. It reconnects automatically on transient errors
-	// and returns only when ctx is cancelled.
-	Watch(ctx context.Context, getSeenIDs func() map[string]struct{}, processDays int, onNew func([]Email))
+	// emails are available, with a context carrying the trace of the fetch
+	// that found them. It reconnects automatically on transient errors and
+	// returns only when ctx is cancelled.
+	Watch(ctx context.Context, seen func(id string) bool, processDays int, onNew func(context.Context, []Email))
+}
+
+// Observer is told about a receiver's activity, for metrics and monitoring.
+// Its methods are called on the receiver's goroutine and must not block.
+type Observer interface {
+	// Fetched reports one check of the mailbox: the number of messages found
+	// on the server, how many of them were new, how long the check took and
+	// the error that ended it, if any.
+	Fetched(found, fresh int, took time.Duration, err error)
+
+	// Idle reports that a Watch session entered (true) or left (false) IMAP
+	// IDLE.
+	Idle(active bool)
+
+	// Reconnect reports that a Watch session failed with err and will be
+	// retried.
+	Reconnect(err error)
+}
+
+// Observable is implemented by receivers that report their activity to an
+// Observer.
+type Observable interface {
+	// Observe sets the observer. It must be called before the receiver is
+	// used.
+	Observe(obs Observer)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) Fetched(int, int, time.Duration, error) {}
+func (nopObserver) Idle(bool)                              {}
+func (nopObserver) Reconnect(error)                        {}
+
+// Lister is an optional interface for receivers that can enumerate the IDs of
+// every message in the mailbox, downloading message bodies only when the
+// content_hash dedup key requires them. It is used
+// to record existing mail as seen when onboarding an account.
+type Lister interface {
+	// ListIDs returns the ID of every message currently in the mailbox,
+	// regardless of age, derived exactly as Fetch derives Email.ID.
+	ListIDs() ([]string, error)
+}
+
+// Retainer is an optional interface for receivers that cannot tell the age of
+// every message, such as POP3 with undated mail. Their Fetch relies on the
+// dedup records of all messages still in the mailbox, which must therefore
+// not be pruned, or those messages would be forwarded again.
+type Retainer interface {
+	// OnServer returns the IDs of the messages in the mailbox at the last
+	// successful Fetch, or nil before the first one or if it could not
+	// identify every message. The map must not be modified.
+	OnServer() map[string]struct{}
+}
+
+// Forgetter is an optional interface for receivers that remember which
+// messages they have already handled, such as POP3 by UIDL, and would
+// otherwise not download them again.
+type Forgetter interface {
+	// Forget makes the next Fetch consider the message id again, after its
+	// dedup record was reset for a retry.
+	Forget(id string)
+}
+
+// Finder is an optional interface for receivers that can look up a single
+// message by its Message-ID header, regardless of its age or dedup state.
+type Finder interface {
+	// Find returns the message whose Message-ID header is messageID, or
+	// false if the mailbox holds none.
+	Find(messageID string) (Email, bool, error)
+}
+
+// Tester is an optional interface for receivers that can check their
+// settings against the server without fetching or changing any mail.
+type Tester interface {
+	// Test connects and logs in as Fetch would, and reports what it found
+	// along the way, counting the messages of the last processDays days.
+	Test(processDays int) Diagnosis
+}
+
+// Diagnosis is the outcome of Tester.Test. Err is set if a step failed; the
+// fields describing later steps are then left unset.
+type Diagnosis struct {
+	Addr         string
+	Connected    bool
+	TLS          *tls.ConnectionState // nil if the connection is not encrypted
+	Capabilities []string             // IMAP CAPABILITY after login, or POP3 CAPA
+	LoggedIn     bool
+	Folder       string // IMAP folder; empty for POP3
+	Messages     int    // messages in the folder or mailbox
+	InWindow     int    // of which dated within processDays
+	Err          error
+}
+
+// testDialTimeout bounds connecting to the server in Test.
+const testDialTimeout = 15 * time.Second
+
+// sameMessageID reports whether two Message-ID values name the same message.
+// IMAP envelopes omit the angle brackets that raw headers keep.
+func sameMessageID(a, b string) bool {
+	trim := func(id string) string {
+		id = strings.TrimSpace(id)
+		return strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	}
+	return a != "" && trim(a) == trim(b)
 }
@@ -0,0 +1,146 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Span describes one weekly delivery window: the days it starts on and its
+// start and end clock times ("HH:MM"). An end at or before the start makes the
+// window run past midnight into the next day. Empty Days means every day.
+type Span struct {
+	Days  []string
+	Start string
+	End   string
+}
+
+// Hours is a set of weekly delivery windows in a fixed time zone.
+type Hours struct {
+	loc   *time.Location
+	spans []span
+}
+
+type span struct {
+	days       uint8 // bit i set = time.Weekday(i) allowed
+	start, end int   // minutes since midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// NewHours builds delivery hours from spans in the IANA time zone zone
+// (e.g. "Europe/Berlin"). An empty zone means the local time zone.
+func NewHours(zone string, spans []Span) (*Hours, error) {
+	loc := time.Local
+	if zone != "" {
+		var err error
+		if loc, err = time.LoadLocation(zone); err != nil {
+			return nil, fmt.Errorf("time zone %q: %w", zone, err)
+		}
+	}
+	if len(spans) == 0 {
+		return nil, fmt.Errorf("at least one window is required")
+	}
+
+	h := &Hours{loc: loc}
+	for i, sp := range spans {
+		var s span
+		if len(sp.Days) == 0 {
+			s.days = 0x7f
+		}
+		for _, d := range sp.Days {
+			wd, ok := weekdays[strings.ToLower(strings.TrimSpace(d))]
+			if !ok {
+				return nil, fmt.Errorf("window %d: unknown day %q", i+1, d)
+			}
+			s.days |= 1 << uint(wd)
+		}
+
+		var err error
+		if s.start, err = parseClock(sp.Start); err != nil {
+			return nil, fmt.Errorf("window %d: start: %w", i+1, err)
+		}
+		if s.end, err = parseClock(sp.End); err != nil {
+			return nil, fmt.Errorf("window %d: end: %w", i+1, err)
+		}
+		if s.start == s.end {
+			return nil, fmt.Errorf("window %d: start and end must differ", i+1)
+		}
+		h.spans = append(h.spans, s)
+	}
+	return h, nil
+}
+
+// Open reports whether t falls inside any window.
+func (h *Hours) Open(t time.Time) bool {
+	t = t.In(h.loc)
+	m := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, s := range h.spans {
+		if s.start < s.end {
+			if s.has(today) && m >= s.start && m < s.end {
+				return true
+			}
+			continue
+		}
+		// Overnight window: open from start until midnight on its own day,
+		// and from midnight until end on the following day.
+		if (s.has(today) && m >= s.start) || (s.has(yesterday) && m < s.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns t if a window is open at t, and otherwise the time the
+// next window opens.
+func (h *Hours) NextOpen(t time.Time) time.Time {
+	if h.Open(t) {
+		return t
+	}
+
+	local := t.In(h.loc)
+	var next time.Time
+	for offset := 0; offset <= 7; offset++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, h.loc)
+		for _, s := range h.spans {
+			if !s.has(day.Weekday()) {
+				continue
+			}
+			at := time.Date(day.Year(), day.Month(), day.Day(), s.start/60, s.start%60, 0, 0, h.loc)
+			if at.After(t) && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return next
+}
+
+func (s span) has(wd time.Weekday) bool {
+	return s.days&(1<<uint(wd)) != 0
+}
+
+// parseClock parses "HH:MM" (00:00-24:00) into minutes since midnight.
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		if v == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
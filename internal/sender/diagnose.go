@@ -0,0 +1,114 @@
+package sender
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// testDialTimeout bounds connecting to the server in Test.
+const testDialTimeout = 15 * time.Second
+
+// Diagnosis is the outcome of Test. Err is set if a step failed; the fields
+// describing later steps are then left unset.
+type Diagnosis struct {
+	Addr       string
+	Connected  bool
+	TLS        *tls.ConnectionState // nil if the connection is not encrypted
+	StartTLS   bool                 // TLS was negotiated with STARTTLS
+	Extensions []string             // EHLO keywords, after STARTTLS if used
+	Auth       bool                 // credentials configured and accepted
+	Err        error
+}
+
+// Test connects to the SMTP server as Forward would, including STARTTLS and
+// login, and reports what it found along the way. It sends no mail.
+func (s *Sender) Test() Diagnosis {
+	srv := s.server.Load()
+	addr := net.JoinHostPort(srv.host, fmt.Sprintf("%d", srv.port))
+	d := Diagnosis{Addr: addr}
+
+	dialer := &net.Dialer{Timeout: testDialTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if srv.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: srv.host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		d.Err = fmt.Errorf("smtp dial %s: %w", addr, err)
+		return d
+	}
+	client, err := smtp.NewClient(conn, srv.host)
+	if err != nil {
+		conn.Close()
+		d.Err = fmt.Errorf("smtp new client: %w", err)
+		return d
+	}
+	defer client.Close()
+	d.Connected = true
+
+	d.Extensions, err = ehlo(client)
+	if err != nil {
+		d.Err = err
+		return d
+	}
+	if !srv.useTLS && hasExtension(d.Extensions, "STARTTLS") {
+		if err := client.StartTLS(&tls.Config{ServerName: srv.host}); err != nil {
+			d.Err = fmt.Errorf("smtp STARTTLS: %w", err)
+			return d
+		}
+		d.StartTLS = true
+		if d.Extensions, err = ehlo(client); err != nil {
+			d.Err = err
+			return d
+		}
+	}
+	if state, ok := client.TLSConnectionState(); ok {
+		d.TLS = &state
+	}
+
+	if srv.username != "" && srv.password != "" {
+		if err := client.Auth(smtp.PlainAuth("", srv.username, srv.password, srv.host)); err != nil {
+			d.Err = fmt.Errorf("smtp auth: %w", err)
+			return d
+		}
+		d.Auth = true
+	}
+	client.Quit()
+	return d
+}
+
+// ehlo sends EHLO and returns the extension keywords of the reply, one per
+// line with their parameters. smtp.Client keeps these to itself.
+func ehlo(client *smtp.Client) ([]string, error) {
+	id, err := client.Text.Cmd("EHLO localhost")
+	if err != nil {
+		return nil, fmt.Errorf("smtp EHLO: %w", err)
+	}
+	client.Text.StartResponse(id)
+	_, msg, err := client.Text.ReadResponse(250)
+	client.Text.EndResponse(id)
+	if err != nil {
+		return nil, fmt.Errorf("smtp EHLO: %w", err)
+	}
+	// The first line greets the client; each further line is an extension.
+	lines := strings.Split(msg, "\n")
+	return lines[1:], nil
+}
+
+// hasExtension reports whether the EHLO keywords in exts include name.
+func hasExtension(exts []string, name string) bool {
+	for _, ext := range exts {
+		if keyword, _, _ := strings.Cut(ext, " "); strings.EqualFold(keyword, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+const (
+	throttleMinDelay   = 1 * time.Minute
+	throttleMaxDelay   = 30 * time.Minute
+	maxThrottleRetries = 5
+)
+
+// Limit describes a token-bucket rate limit. A zero field disables that
+// dimension of the limit.
+type Limit struct {
+	MessagesPerMinute int
+	BytesPerHour      int64
+}
+
+// bucket is a token bucket that allows bursts up to capacity and refills
+// continuously at rate tokens per second. Tokens may go negative: callers
+// reserve what they need and wait until the debt is repaid, which queues
+// concurrent senders in arrival order instead of failing them.
+type bucket struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64
+	last     time.Time
+}
+
+func newBucket(capacity float64, per time.Duration) *bucket {
+	return &bucket{
+		capacity: capacity,
+		tokens:   capacity,
+		rate:     capacity / per.Seconds(),
+		last:     time.Now(),
+	}
+}
+
+// reserve takes n tokens and returns how long the caller must wait before
+// using them. Requests larger than the bucket are capped at its capacity so
+// an oversized message waits for a full bucket rather than forever.
+func (b *bucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	b.tokens -= min(n, b.capacity)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limiter combines a message-count bucket and a byte-volume bucket.
+// Either bucket may be nil when that dimension is unlimited.
+type limiter struct {
+	msgs  *bucket
+	bytes *bucket
+}
+
+func newLimiter(l Limit) *limiter {
+	lim := &limiter{}
+	if l.MessagesPerMinute > 0 {
+		lim.msgs = newBucket(float64(l.MessagesPerMinute), time.Minute)
+	}
+	if l.BytesPerHour > 0 {
+		lim.bytes = newBucket(float64(l.BytesPerHour), time.Hour)
+	}
+	return lim
+}
+
+// delay reserves capacity for one message of size bytes and returns the
+// time to wait before sending it.
+func (l *limiter) delay(size int) time.Duration {
+	var d time.Duration
+	if l.msgs != nil {
+		d = max(d, l.msgs.reserve(1))
+	}
+	if l.bytes != nil {
+		d = max(d, l.bytes.reserve(float64(size)))
+	}
+	return d
+}
+
+// throttle tracks the slow-down requested by the SMTP server via 421/451
+// replies. Each throttle reply doubles the pause; each success halves it.
+type throttle struct {
+	mu    sync.Mutex
+	delay time.Duration
+	until time.Time
+}
+
+// penalize records a throttle reply and returns the pause before the next send.
+func (t *throttle) penalize() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.delay = min(max(t.delay*2, throttleMinDelay), throttleMaxDelay)
+	t.until = time.Now().Add(t.delay)
+	return t.delay
+}
+
+// relax gradually lifts the slow-down after a successful send.
+func (t *throttle) relax() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.delay /= 2
+	if t.delay < throttleMinDelay {
+		t.delay = 0
+	}
+}
+
+// wait returns how long to pause until the current throttle window ends.
+func (t *throttle) wait() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Until(t.until)
+}
+
+// isThrottle reports whether err is an SMTP 421 or 451 reply, which relays
+// such as Gmail and Microsoft 365 use to ask clients to slow down.
+func isThrottle(err error) bool {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return false
+	}
+	return tpErr.Code == 421 || tpErr.Code == 451
+}
+
+// sleep waits for d or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
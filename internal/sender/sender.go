@@ -2,47 +2,203 @@ package sender
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	netmail "net/mail"
 	"net/smtp"
+	"net/textproto"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-message/mail"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tracyhatemice/gomailify/internal/tracing"
 )
 
+var tracer = otel.Tracer("github.com/tracyhatemice/gomailify/internal/sender")
+
 // Sender forwards raw email messages over SMTP.
 type Sender struct {
+	server atomic.Pointer[server]
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	global    *limiter
+	perDest   Limit
+	destLimit map[string]*limiter // keyed by lower-cased destination address
+	throttle  throttle
+}
+
+// server holds the SMTP server settings. It is replaced as a whole so that a
+// send in progress never sees a mix of old and new settings.
+type server struct {
 	host     string
 	port     int
 	username string
 	password string
 	useTLS   bool
-	logger   *slog.Logger
+	from     string
 }
 
-// New creates a new SMTP sender.
-func New(host string, port int, username, password string, useTLS bool, logger *slog.Logger) *Sender {
-	return &Sender{
+// New creates a new SMTP sender. from is the address of messages gomailify
+// composes itself; if empty, username is used.
+func New(host string, port int, username, password string, useTLS bool, from string, logger *slog.Logger) *Sender {
+	s := &Sender{
+		logger: logger,
+		global: newLimiter(Limit{}),
+	}
+	s.SetServer(host, port, username, password, useTLS, from)
+	return s
+}
+
+// SetServer replaces the SMTP server settings. Sends already in progress
+// complete with the previous settings.
+func (s *Sender) SetServer(host string, port int, username, password string, useTLS bool, from string) {
+	s.server.Store(&server{
 		host:     host,
 		port:     port,
 		username: username,
 		password: password,
 		useTLS:   useTLS,
-		logger:   logger,
+		from:     from,
+	})
+}
+
+// SetRateLimits configures the outbound rate limits. global applies to all
+// messages sent through s; perDestination applies separately to each
+// recipient address.
+func (s *Sender) SetRateLimits(global, perDestination Limit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.global = newLimiter(global)
+	s.perDest = perDestination
+	s.destLimit = make(map[string]*limiter)
+}
+
+// Receipt describes a message accepted by the SMTP server.
+type Receipt struct {
+	Reply   string // text of the server's final reply to DATA, e.g. "2.0.0 Ok: queued as 4Xyz"
+	QueueID string // queue ID found in Reply; empty if none was recognised
+}
+
+// Forward sends raw email content to the target address. It blocks while the
+// configured rate limits or a server throttle require, and returns early only
+// if ctx is cancelled.
+func (s *Sender) Forward(ctx context.Context, rawEmail []byte, to string, originalID string) (_ Receipt, err error) {
+	ctx, span := tracer.Start(ctx, "sender.forward", trace.WithAttributes(
+		attribute.String("to", to),
+		attribute.String("message_id", originalID),
+		attribute.Int("size", len(rawEmail)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	from, message := s.prepare(rawEmail, originalID)
+	return s.deliver(ctx, from, to, message)
+}
+
+// Preview returns the envelope sender and the exact message Forward would
+// relay for rawEmail, without contacting the SMTP server.
+func (s *Sender) Preview(rawEmail []byte, originalID string) (string, []byte) {
+	return s.prepare(rawEmail, originalID)
+}
+
+// Send delivers a message composed by gomailify itself (such as a digest)
+// to the target address, using the sender's own address as envelope sender.
+// It is subject to the same rate limits as Forward.
+func (s *Sender) Send(ctx context.Context, message []byte, to string) (_ Receipt, err error) {
+	ctx, span := tracer.Start(ctx, "sender.send", trace.WithAttributes(
+		attribute.String("to", to),
+		attribute.Int("size", len(message)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	return s.deliver(ctx, s.Address(), to, message)
+}
+
+// Address returns the address gomailify uses as the author of messages it
+// composes itself: the configured from address, or else the account used to
+// authenticate with the SMTP server.
+func (s *Sender) Address() string {
+	srv := s.server.Load()
+	return cmp.Or(srv.from, srv.username)
+}
+
+// deliver sends message, waiting for rate limits and retrying on throttle
+// replies. The message takes its place in the rate limits once; a retry only
+// waits for the throttle window to pass.
+func (s *Sender) deliver(ctx context.Context, from, to string, message []byte) (Receipt, error) {
+	_, wait := tracer.Start(ctx, "sender.wait_turn")
+	err := s.waitTurn(ctx, to, len(message))
+	tracing.End(wait, err)
+	if err != nil {
+		return Receipt{}, err
+	}
+	for attempt := 0; ; attempt++ {
+		reply, err := s.send(ctx, from, to, message)
+		if err == nil {
+			s.throttle.relax()
+			return Receipt{Reply: reply, QueueID: QueueID(reply)}, nil
+		}
+		if !isThrottle(err) || attempt >= maxThrottleRetries {
+			return Receipt{}, err
+		}
+		s.logger.Warn("smtp server is throttling, slowing down",
+			"to", to,
+			"error", err,
+			"retry_in", s.throttle.penalize(),
+		)
+		_, wait := tracer.Start(ctx, "sender.wait_turn")
+		err = sleep(ctx, s.throttle.wait())
+		tracing.End(wait, err)
+		if err != nil {
+			return Receipt{}, err
+		}
 	}
 }
 
-// Forward sends raw email content to the target address.
-func (s *Sender) Forward(rawEmail []byte, to string, originalID string) error {
-	addr := net.JoinHostPort(s.host, fmt.Sprintf("%d", s.port))
+// waitTurn blocks until the throttle window has passed and both the global
+// and the per-destination buckets have room for a message of size bytes.
+func (s *Sender) waitTurn(ctx context.Context, to string, size int) error {
+	if err := sleep(ctx, s.throttle.wait()); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delay := s.global.delay(size)
+	if s.perDest != (Limit{}) {
+		key := strings.ToLower(to)
+		dl, ok := s.destLimit[key]
+		if !ok {
+			dl = newLimiter(s.perDest)
+			s.destLimit[key] = dl
+		}
+		delay = max(delay, dl.delay(size))
+	}
+	s.mu.Unlock()
+
+	if delay > 0 {
+		s.logger.Debug("rate limited, waiting", "to", to, "wait", delay)
+	}
+	return sleep(ctx, delay)
+}
 
+// prepare derives the envelope sender from rawEmail and returns the message
+// as it will be relayed, with the From header rewritten and the forwarding
+// headers prepended.
+func (s *Sender) prepare(rawEmail []byte, originalID string) (string, []byte) {
 	// Parse the original email to extract the From header for envelope.
-	from := s.username
+	from := s.Address()
 	reader, err := mail.CreateReader(strings.NewReader(string(rawEmail)))
 	if err == nil {
 		defer reader.Close()
@@ -60,63 +216,160 @@ func (s *Sender) Forward(rawEmail []byte, to string, originalID string) error {
 		originalID,
 		time.Now().UTC().Format(time.RFC3339),
 	)
-	message := append([]byte(forwardHeaders), rawEmail...)
+	return from, append([]byte(forwardHeaders), rawEmail...)
+}
 
-	var client *smtp.Client
+// send delivers message in a single SMTP transaction, tracing each stage in
+// its own span. It returns the text of the server's reply accepting the
+// message.
+func (s *Sender) send(ctx context.Context, from, to string, message []byte) (string, error) {
+	srv := s.server.Load()
 
-	if s.useTLS {
-		tlsConfig := &tls.Config{ServerName: s.host}
-		conn, err := tls.Dial("tcp", addr, tlsConfig)
+	_, span := tracer.Start(ctx, "smtp.connect", trace.WithAttributes(attribute.String("server", srv.host)))
+	client, err := s.connect(srv)
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	// Authenticate if credentials are provided.
+	if srv.username != "" && srv.password != "" {
+		_, span := tracer.Start(ctx, "smtp.auth")
+		err := client.Auth(smtp.PlainAuth("", srv.username, srv.password, srv.host))
+		tracing.End(span, err)
 		if err != nil {
-			return fmt.Errorf("smtp tls dial %s: %w", addr, err)
+			return "", fmt.Errorf("smtp auth: %w", err)
 		}
-		client, err = smtp.NewClient(conn, s.host)
+	}
+
+	_, span = tracer.Start(ctx, "smtp.envelope")
+	err = envelope(client, from, to)
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+
+	_, span = tracer.Start(ctx, "smtp.data", trace.WithAttributes(attribute.Int("size", len(message))))
+	reply, err := data(client, message)
+	if err == nil {
+		span.SetAttributes(attribute.String("reply", reply))
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+
+	// The message is accepted; a failed QUIT does not change that.
+	client.Quit()
+	return reply, nil
+}
+
+// connect opens a connection to srv, over implicit TLS or upgraded with
+// STARTTLS when the server offers it.
+func (s *Sender) connect(srv *server) (*smtp.Client, error) {
+	addr := net.JoinHostPort(srv.host, fmt.Sprintf("%d", srv.port))
+	if srv.useTLS {
+		tlsConfig := &tls.Config{ServerName: srv.host}
+		conn, err := tls.Dial("tcp", addr, tlsConfig)
 		if err != nil {
-			conn.Close()
-			return fmt.Errorf("smtp new client: %w", err)
+			return nil, fmt.Errorf("smtp tls dial %s: %w", addr, err)
 		}
-	} else {
-		client, err = smtp.Dial(addr)
+		client, err := smtp.NewClient(conn, srv.host)
 		if err != nil {
-			return fmt.Errorf("smtp dial %s: %w", addr, err)
-		}
-		// Try STARTTLS if available.
-		if ok, _ := client.Extension("STARTTLS"); ok {
-			tlsConfig := &tls.Config{ServerName: s.host}
-			if err := client.StartTLS(tlsConfig); err != nil {
-				s.logger.Warn("STARTTLS failed, continuing without TLS", "error", err)
-			}
+			conn.Close()
+			return nil, fmt.Errorf("smtp new client: %w", err)
 		}
+		return client, nil
 	}
-	defer client.Close()
 
-	// Authenticate if credentials are provided.
-	if s.username != "" && s.password != "" {
-		auth := smtp.PlainAuth("", s.username, s.password, s.host)
-		if err := client.Auth(auth); err != nil {
-			return fmt.Errorf("smtp auth: %w", err)
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("smtp dial %s: %w", addr, err)
+	}
+	// Try STARTTLS if available.
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		tlsConfig := &tls.Config{ServerName: srv.host}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			s.logger.Warn("STARTTLS failed, continuing without TLS", "error", err)
 		}
 	}
+	return client, nil
+}
 
+// envelope sends the MAIL FROM and RCPT TO commands.
+func envelope(client *smtp.Client, from, to string) error {
 	if err := client.Mail(from); err != nil {
 		return fmt.Errorf("smtp MAIL FROM: %w", err)
 	}
 	if err := client.Rcpt(to); err != nil {
 		return fmt.Errorf("smtp RCPT TO: %w", err)
 	}
+	return nil
+}
 
-	w, err := client.Data()
+// data transfers message with the DATA command and returns the text of the
+// server's final reply. It talks to the connection directly because
+// smtp.Client discards that reply, which carries the queue ID.
+func data(client *smtp.Client, message []byte) (string, error) {
+	id, err := client.Text.Cmd("DATA")
 	if err != nil {
-		return fmt.Errorf("smtp DATA: %w", err)
+		return "", fmt.Errorf("smtp DATA: %w", err)
 	}
+	client.Text.StartResponse(id)
+	_, _, err = client.Text.ReadResponse(354)
+	client.Text.EndResponse(id)
+	if err != nil {
+		return "", fmt.Errorf("smtp DATA: %w", err)
+	}
+
+	w := client.Text.DotWriter()
 	if _, err := w.Write(message); err != nil {
-		return fmt.Errorf("smtp write: %w", err)
+		w.Close()
+		return "", fmt.Errorf("smtp write: %w", err)
 	}
 	if err := w.Close(); err != nil {
-		return fmt.Errorf("smtp close data: %w", err)
+		return "", fmt.Errorf("smtp write: %w", err)
+	}
+	_, reply, err := client.Text.ReadResponse(250)
+	if err != nil {
+		return "", fmt.Errorf("smtp close data: %w", err)
 	}
+	return reply, nil
+}
+
+// queueIDPatterns find the queue ID in the replies of common relays.
+var queueIDPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`queued as ([0-9A-Za-z]+)`),                           // Postfix
+	regexp.MustCompile(`\bid=([0-9A-Za-z-]+)`),                               // Exim
+	regexp.MustCompile(`InternalId=(\d+)`),                                   // Exchange, Microsoft 365
+	regexp.MustCompile(`(?i)^(?:\d\.\d\.\d\s+)?OK\s+\d+\s+(\S+) - gsmtp`),    // Gmail
+	regexp.MustCompile(`^(?:\d\.\d\.\d\s+)?([0-9A-Za-z]+) Message accepted`), // Sendmail
+}
+
+// QueueID extracts the queue ID from the text of a reply to DATA, or returns
+// "" if the reply has none in a recognised format.
+func QueueID(reply string) string {
+	for _, re := range queueIDPatterns {
+		if m := re.FindStringSubmatch(reply); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
 
-	return client.Quit()
+// ReplyClass returns the class of the SMTP reply that ended a delivery: "2xx"
+// when err is nil, "4xx" or "5xx" for a rejection by the server, and "none"
+// when no reply was received, such as when the connection failed.
+func ReplyClass(err error) string {
+	if err == nil {
+		return "2xx"
+	}
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) && tpErr.Code >= 200 && tpErr.Code < 600 {
+		return fmt.Sprintf("%dxx", tpErr.Code/100)
+	}
+	return "none"
 }
 
 // fromRe matches the From header line within the header section (handles folded headers).
@@ -0,0 +1,242 @@
+package spool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tracyhatemice/gomailify/internal/receiver"
+)
+
+const fileExt = ".json"
+
+// flushedFile records when the spool was last flushed. Its name lacks
+// fileExt, so it is never taken for an entry.
+const flushedFile = "flushed"
+
+// Spool is a durable on-disk holding area for fetched emails that are not
+// delivered immediately. Each email is stored in its own file so that adding
+// or removing one never rewrites the others.
+type Spool struct {
+	mu  sync.Mutex
+	dir string
+	ids map[string]string // email ID → file name
+}
+
+// entry is the on-disk form of a spooled email.
+type entry struct {
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id,omitempty"`
+	Date      time.Time `json:"date"`
+	Added     time.Time `json:"added"`
+	Content   []byte    `json:"content"`
+}
+
+// Open loads (or creates) a spool backed by dir.
+func Open(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create spool dir: %w", err)
+	}
+
+	s := &Spool{
+		dir: dir,
+		ids: make(map[string]string),
+	}
+
+	names, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		e, err := s.read(name)
+		if err != nil {
+			return nil, err
+		}
+		s.ids[e.ID] = name
+	}
+	return s, nil
+}
+
+// Add stores email in the spool. Adding an ID that is already present is a no-op.
+func (s *Spool) Add(email receiver.Email) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.ids[email.ID]; exists {
+		return nil
+	}
+
+	data, err := json.Marshal(entry{
+		ID:        email.ID,
+		MessageID: email.MessageID,
+		Date:      email.Date,
+		Added:     time.Now(),
+		Content:   email.Content,
+	})
+	if err != nil {
+		return fmt.Errorf("encode spool entry: %w", err)
+	}
+
+	name := fileName(email.ID)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write spool entry: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("commit spool entry: %w", err)
+	}
+	s.ids[email.ID] = name
+	return nil
+}
+
+// Has reports whether id is currently held in the spool.
+func (s *Spool) Has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+// IDs returns the IDs of all spooled emails.
+func (s *Spool) IDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.ids))
+	for id := range s.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// List returns all spooled emails ordered by date, oldest first.
+func (s *Spool) List() ([]receiver.Email, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	emails := make([]receiver.Email, 0, len(s.ids))
+	for _, name := range s.ids {
+		e, err := s.read(name)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, receiver.Email{ID: e.ID, MessageID: e.MessageID, Date: e.Date, Content: e.Content})
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].Date.Before(emails[j].Date)
+	})
+	return emails, nil
+}
+
+// Remove deletes id from the spool. Removing an unknown ID is a no-op.
+func (s *Spool) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.ids[id]
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove spool entry: %w", err)
+	}
+	delete(s.ids, id)
+	return nil
+}
+
+// Flushed returns the time recorded by SetFlushed, or the zero time if none
+// was.
+func (s *Spool) Flushed() (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, flushedFile))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("read spool flush time: %w", err)
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse spool flush time: %w", err)
+	}
+	return t, nil
+}
+
+// SetFlushed records t as the time the spool was last flushed, such as when
+// a digest of its emails was sent.
+func (s *Spool) SetFlushed(t time.Time) error {
+	path := filepath.Join(s.dir, flushedFile)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, []byte(t.UTC().Format(time.RFC3339Nano)+"\n")); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write spool flush time: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("commit spool flush time: %w", err)
+	}
+	return nil
+}
+
+// Len returns the number of spooled emails.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ids)
+}
+
+// files lists the committed entry files in the spool directory.
+func (s *Spool) files() ([]string, error) {
+	dirents, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read spool dir: %w", err)
+	}
+	var names []string
+	for _, d := range dirents {
+		if d.Type().IsRegular() && strings.HasSuffix(d.Name(), fileExt) {
+			names = append(names, d.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *Spool) read(name string) (entry, error) {
+	var e entry
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return e, fmt.Errorf("read spool entry: %w", err)
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return e, fmt.Errorf("decode spool entry %s: %w", name, err)
+	}
+	return e, nil
+}
+
+// fileName maps an email ID to a file name that is safe on any filesystem.
+func fileName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:]) + fileExt
+}
+
+// writeFileSync writes data to path and flushes it to stable storage, so a
+// crash after the subsequent rename cannot leave an empty entry behind.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}